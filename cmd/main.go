@@ -1,13 +1,25 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"os"
 
 	internal "github.com/thomseddon/traefik-forward-auth/internal"
 )
 
 // Main
 func main() {
+	// Developer commands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "cookie":
+			runCommand(internal.CookieCommand)
+		case "validate":
+			runCommand(internal.ValidateCommand)
+		}
+	}
+
 	// Parse options
 	config := internal.NewGlobalConfig()
 
@@ -19,12 +31,28 @@ func main() {
 
 	// Build server
 	server := internal.NewServer()
+	server.ReloadOnSignal(os.Args[1:])
 
 	// Attach router to default server
 	http.HandleFunc("/", server.RootHandler)
 
 	// Start
-	log.Debugf("Starting with options: %s", config)
+	log.WithFields(config.LogFields()).Info("Starting with options")
 	log.Info("Listening on :4181")
-	log.Info(http.ListenAndServe(":4181", nil))
+	srv := &http.Server{
+		Addr:           ":4181",
+		MaxHeaderBytes: config.ServerMaxHeaderBytes(),
+	}
+	log.Info(srv.ListenAndServe())
+}
+
+func runCommand(cmd func(args []string) (string, error)) {
+	out, err := cmd(os.Args[2:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println(out)
+	os.Exit(0)
 }
@@ -7,21 +7,40 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+	"golang.org/x/net/idna"
 )
 
 // Request Validation
 
-// Cookie = hash(secret, cookie domain, email, expires)|expires|email
+// Cookie = v1.hash(secret, cookie domain, email, expires)|expires|email
+// When the session idle timeout is enabled, the time of the last activity is
+// also recorded:
+// Cookie = v1.hash(secret, cookie domain, email, expires, activity)|expires|email|activity
+// Session cookies, which the browser discards when closed, have an "s" suffix
+// on expires
+//
+// The format version prefix allows the format to change while instances that
+// only understand the previous format are still running:
+//
+//	none: cookies from before the format was versioned
+//	v1:   the same fields, with the version prefix
 func ValidateCookie(r *http.Request, c *http.Cookie) (string, error) {
-	parts := strings.Split(c.Value, "|")
+	version, value := splitCookieVersion(c.Value)
+	if version < 0 || version > cookieVersion {
+		return "", errors.New("Unsupported cookie version")
+	}
+
+	parts := strings.Split(value, "|")
 
-	if len(parts) != 3 {
+	if len(parts) != 3 && len(parts) != 4 {
 		return "", errors.New("Invalid cookie format")
 	}
 
@@ -30,18 +49,35 @@ func ValidateCookie(r *http.Request, c *http.Cookie) (string, error) {
 		return "", errors.New("Unable to decode cookie mac")
 	}
 
-	expectedSignature := cookieSignature(r, parts[2], parts[1])
-	expected, err := base64.URLEncoding.DecodeString(expectedSignature)
-	if err != nil {
-		return "", errors.New("Unable to generate mac")
+	var activity string
+	if len(parts) == 4 {
+		activity = parts[3]
 	}
 
-	// Valid token?
-	if !hmac.Equal(mac, expected) {
+	// Valid token? Cookies signed with any validation secret are accepted
+	valid := false
+	for _, secret := range append([][]byte{config.Secret}, config.ValidationSecrets...) {
+		expectedSignature := cookieSignatureWithSecret(secret, r, parts[2], parts[1], activity)
+		expected, err := base64.URLEncoding.DecodeString(expectedSignature)
+		if err != nil {
+			return "", errors.New("Unable to generate mac")
+		}
+
+		if hmac.Equal(mac, expected) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		// A bound cookie presented by a different client can't be told
+		// apart from a forged one
+		if len(config.BindCookieTo) > 0 {
+			return "", errors.New("Invalid cookie mac or bound to a different client")
+		}
 		return "", errors.New("Invalid cookie mac")
 	}
 
-	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	expires, err := strconv.ParseInt(strings.TrimSuffix(parts[1], sessionCookieSuffix), 10, 64)
 	if err != nil {
 		return "", errors.New("Unable to parse cookie expiry")
 	}
@@ -51,14 +87,29 @@ func ValidateCookie(r *http.Request, c *http.Cookie) (string, error) {
 		return "", errors.New("Cookie has expired")
 	}
 
+	// Has it been idle too long? Cookies without activity were issued before
+	// the idle timeout was enabled, so will be given activity when refreshed
+	if config.SessionIdleTimeout > 0 && activity != "" {
+		last, err := strconv.ParseInt(activity, 10, 64)
+		if err != nil {
+			return "", errors.New("Unable to parse cookie activity")
+		}
+
+		if time.Unix(last, 0).Add(config.SessionIdleTimeout).Before(time.Now()) {
+			return "", errors.New("Cookie has been idle for too long")
+		}
+	}
+
 	// Looks valid
 	return parts[2], nil
 }
 
-// Validate email
+// Validate email, the domain is compared in its ASCII (punycode) form so
+// internationalised domains match however they were entered
 func ValidateEmail(email string) bool {
 	found := false
 	if len(config.Whitelist) > 0 {
+		email = normalizeEmail(email)
 		for _, whitelist := range config.Whitelist {
 			if email == whitelist {
 				found = true
@@ -69,8 +120,9 @@ func ValidateEmail(email string) bool {
 		if len(parts) < 2 {
 			return false
 		}
-		for _, domain := range config.Domains {
-			if domain == parts[1] {
+		domain := normalizeDomain(parts[len(parts)-1])
+		for _, d := range config.Domains {
+			if d == domain {
 				found = true
 			}
 		}
@@ -81,20 +133,180 @@ func ValidateEmail(email string) bool {
 	return found
 }
 
+// Convert a domain to its lowercase ASCII form, e.g. "Müller.de" becomes
+// "xn--mller-kva.de". Domains that can't be converted are just lowercased
+func normalizeDomain(domain string) string {
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+
+	return ascii
+}
+
+// Normalise the domain of an email address
+func normalizeEmail(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return email
+	}
+
+	return email[:i+1] + normalizeDomain(email[i+1:])
+}
+
+// Is the request a CORS preflight from an allowed origin
+func ValidateCORSPreflight(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if r.Method != "OPTIONS" || origin == "" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	for _, allowed := range config.CORSAllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
 // OAuth Methods
 
 // Get login url
 func GetLoginURL(r *http.Request, nonce string) string {
-	state := fmt.Sprintf("%s:%s", nonce, returnUrl(r))
+	return getLoginURL(r, "default", nonce, returnUrl(r), config.RememberMe)
+}
+
+// Get login url, a login that should not be remembered and any max age are
+// marked in the state so they survive the round trip to the provider
+func getLoginURL(r *http.Request, rule, nonce, redirect string, remember bool) string {
+	maxAge, hasMaxAge := loginMaxAge(r, rule)
+	if hasMaxAge {
+		redirect = fmt.Sprintf("%s%d:%s", maxAgeStatePrefix, int64(maxAge/time.Second), redirect)
+	}
+
+	state := fmt.Sprintf("%s:%s", nonce, redirect)
+	if !remember {
+		state = fmt.Sprintf("%s:%s%s", nonce, sessionStatePrefix, redirect)
+	}
 
 	// TODO: Support multiple providers
-	return config.Providers.Google.GetLoginURL(redirectUri(r), state)
+	loginURL := config.Providers.Google.GetLoginURL(redirectUri(r), state)
+
+	// Ask the provider to re-authenticate users that last logged in too long ago
+	if hasMaxAge {
+		u, err := url.Parse(loginURL)
+		if err == nil {
+			q := u.Query()
+			q.Set("max_age", strconv.FormatInt(int64(maxAge/time.Second), 10))
+			q.Set("prompt", addPrompt(q.Get("prompt"), "login"))
+			u.RawQuery = q.Encode()
+			loginURL = u.String()
+		}
+	}
+
+	return loginURL
+}
+
+// Add an option to a space separated prompt, unless it's already there
+func addPrompt(prompt, option string) string {
+	for _, p := range strings.Fields(prompt) {
+		if p == option {
+			return prompt
+		}
+	}
+
+	return strings.TrimSpace(prompt + " " + option)
+}
+
+// Sessions may be this much older than a requested max age, so a max age
+// shorter than the round trip to the provider (e.g. 0) allows the session
+// created by the login it caused, rather than sending the user to login again
+const maxAgeLeeway = time.Minute
+
+// Get the maximum session age requested by a trusted proxy with the
+// X-Auth-Max-Age header
+func requestedMaxAge(r *http.Request) (time.Duration, bool) {
+	header := r.Header.Get("X-Auth-Max-Age")
+	if !config.TrustAuthMaxAgeHeader || header == "" || !isTrustedProxy(r) {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
+
+// Get the maximum session age for a request, this is the smaller of the rule's
+// max-age and any max age requested by a trusted proxy
+func loginMaxAge(r *http.Request, rule string) (time.Duration, bool) {
+	maxAge, ok := requestedMaxAge(r)
+	if conf, exists := config.Rules[rule]; exists && conf.MaxAge > 0 {
+		ruleMaxAge := time.Duration(conf.MaxAge) * time.Second
+		if !ok || ruleMaxAge < maxAge {
+			maxAge, ok = ruleMaxAge, true
+		}
+	}
+
+	return maxAge, ok
+}
+
+// Split any max age from the redirect returned by splitState
+func splitStateMaxAge(redirect string) (string, time.Duration, bool) {
+	if !strings.HasPrefix(redirect, maxAgeStatePrefix) {
+		return redirect, 0, false
+	}
+
+	parts := strings.SplitN(redirect[len(maxAgeStatePrefix):], ":", 2)
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if len(parts) != 2 || err != nil {
+		return redirect, 0, false
+	}
+
+	return parts[1], time.Duration(seconds) * time.Second, true
+}
+
+// Split the redirect from the state returned by ValidateCSRFCookie, along
+// with whether the login should be remembered
+func splitState(state string) (string, bool) {
+	if strings.HasPrefix(state, sessionStatePrefix) {
+		return state[len(sessionStatePrefix):], false
+	}
+
+	return state, true
+}
+
+// Get the redirect from the state without checking the nonce, this must only
+// be trusted with another proof of the user's identity
+func stateRedirect(state string) string {
+	if len(state) < 34 {
+		return ""
+	}
+
+	redirect, _ := splitState(state[33:])
+	redirect, _, _ = splitStateMaxAge(redirect)
+	return redirect
+}
+
+// Get the parameters the provider returned to the callback with, these are in
+// the body when the provider uses response_mode=form_post
+func callbackParams(r *http.Request) url.Values {
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err == nil && len(r.PostForm) > 0 {
+			return r.PostForm
+		}
+	}
+
+	return r.URL.Query()
 }
 
 // Exchange code for token
 
 func ExchangeCode(r *http.Request) (string, error) {
-	code := r.URL.Query().Get("code")
+	code := callbackParams(r).Get("code")
 
 	// TODO: Support multiple providers
 	return config.Providers.Google.ExchangeCode(redirectUri(r), code)
@@ -134,6 +346,81 @@ func redirectUri(r *http.Request) string {
 	return fmt.Sprintf("%s%s", redirectBase(r), config.Path)
 }
 
+// Get the address of the peer that connected to traefik, traefik appends this
+// to any X-Forwarded-For it received
+func forwardedPeerIP(r *http.Request) net.IP {
+	addrs := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	return net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1]))
+}
+
+// Get the client IP, this is the last address in X-Forwarded-For that is not
+// a trusted proxy, after skipping the configured number of proxies. Addresses
+// are checked from the right as anything to the left may have been set by
+// the client
+func clientIP(r *http.Request) net.IP {
+	addrs := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+
+	start := len(addrs) - 1 - config.ForwardedForDepth
+	if start < 0 {
+		start = 0
+	}
+
+	var ip net.IP
+	for i := start; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(addrs[i]))
+		if ip == nil || !isTrustedIP(ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// Get the client IP for logging
+func sourceIP(r *http.Request) string {
+	if ip := clientIP(r); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
+
+// Is the IP within a blocked network
+func isBlockedIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range config.IPBlocklist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Is the request from a trusted proxy
+func isTrustedProxy(r *http.Request) bool {
+	ip := forwardedPeerIP(r)
+	if ip == nil {
+		return false
+	}
+
+	return isTrustedIP(ip)
+}
+
+// Is the IP within a trusted proxy network
+func isTrustedIP(ip net.IP) bool {
+	for _, network := range config.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Should we use auth host + what it is
 func useAuthDomain(r *http.Request) (bool, string) {
 	if config.AuthHost == "" {
@@ -152,54 +439,380 @@ func useAuthDomain(r *http.Request) (bool, string) {
 
 // Cookie methods
 
+// Get the age of a valid auth cookie, this is derived from its expiry so
+// assumes the lifetime hasn't changed since it was issued
+func cookieAge(c *http.Cookie) time.Duration {
+	_, value := splitCookieVersion(c.Value)
+	parts := strings.Split(value, "|")
+	if len(parts) < 2 {
+		return 0
+	}
+
+	expires, _ := strconv.ParseInt(strings.TrimSuffix(parts[1], sessionCookieSuffix), 10, 64)
+	return time.Since(time.Unix(expires, 0).Add(-config.Lifetime))
+}
+
+// Get when a valid auth cookie stops being accepted, the earlier of its expiry
+// and, with the session idle timeout, its last activity plus the timeout
+func cookieExpires(c *http.Cookie) time.Time {
+	_, value := splitCookieVersion(c.Value)
+	parts := strings.Split(value, "|")
+	if len(parts) < 2 {
+		return time.Time{}
+	}
+
+	expires, _ := strconv.ParseInt(strings.TrimSuffix(parts[1], sessionCookieSuffix), 10, 64)
+	t := time.Unix(expires, 0)
+
+	if config.SessionIdleTimeout > 0 && len(parts) == 4 {
+		last, _ := strconv.ParseInt(parts[3], 10, 64)
+		if idle := time.Unix(last, 0).Add(config.SessionIdleTimeout); idle.Before(t) {
+			t = idle
+		}
+	}
+
+	return t
+}
+
 // Create an auth cookie
 func MakeCookie(r *http.Request, email string) *http.Cookie {
-	expires := cookieExpiry()
-	mac := cookieSignature(r, email, fmt.Sprintf("%d", expires.Unix()))
-	value := fmt.Sprintf("%s|%d|%s", mac, expires.Unix(), email)
+	return makeCookie(r, email, cookieExpiry(), true)
+}
 
-	return &http.Cookie{
+// Create an auth cookie that the browser discards when closed, it is still
+// only valid for the configured lifetime
+func MakeSessionCookie(r *http.Request, email string) *http.Cookie {
+	return makeCookie(r, email, cookieExpiry(), false)
+}
+
+// Record activity on a valid auth cookie for the session idle timeout. To
+// avoid reissuing the cookie on every request, activity is only recorded once
+// a tenth of the idle timeout has passed, nil is returned otherwise
+func RefreshCookie(r *http.Request, c *http.Cookie) *http.Cookie {
+	if config.SessionIdleTimeout == 0 {
+		return nil
+	}
+
+	_, value := splitCookieVersion(c.Value)
+	parts := strings.Split(value, "|")
+	if len(parts) == 4 {
+		last, _ := strconv.ParseInt(parts[3], 10, 64)
+		if time.Since(time.Unix(last, 0)) < config.SessionIdleTimeout/10 {
+			return nil
+		}
+	}
+
+	// Keep the original expiry and persistence
+	persistent := !strings.HasSuffix(parts[1], sessionCookieSuffix)
+	expires, _ := strconv.ParseInt(strings.TrimSuffix(parts[1], sessionCookieSuffix), 10, 64)
+	return makeCookie(r, parts[2], time.Unix(expires, 0), persistent)
+}
+
+func makeCookie(r *http.Request, email string, expires time.Time, persistent bool) *http.Cookie {
+	expiresValue := fmt.Sprintf("%d", expires.Unix())
+	if !persistent {
+		expiresValue += sessionCookieSuffix
+	}
+
+	var value string
+	if config.SessionIdleTimeout > 0 {
+		activity := fmt.Sprintf("%d", time.Now().Unix())
+		mac := cookieSignature(r, email, expiresValue, activity)
+		value = fmt.Sprintf("%s|%s|%s|%s", mac, expiresValue, email, activity)
+	} else {
+		mac := cookieSignature(r, email, expiresValue, "")
+		value = fmt.Sprintf("%s|%s|%s", mac, expiresValue, email)
+	}
+
+	if config.CookieVersion > 0 {
+		value = fmt.Sprintf("v%d.%s", config.CookieVersion, value)
+	}
+
+	secure, sameSite := cookieAttributes(r.Header.Get("X-Forwarded-Host"))
+	c := &http.Cookie{
 		Name:     config.CookieName,
 		Value:    value,
 		Path:     "/",
 		Domain:   cookieDomain(r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
-		Expires:  expires,
+		Secure:   secure,
+		SameSite: sameSite,
+	}
+	if persistent {
+		c.Expires = expires
+	}
+
+	return c
+}
+
+// Create cookies to clear the auth cookie on the request host and on every
+// configured cookie domain
+func ClearCookies(r *http.Request) []*http.Cookie {
+	var cookies []*http.Cookie
+	seen := make(map[string]bool)
+
+	host := removePort(r.Header.Get("X-Forwarded-Host"))
+
+	domains := []string{cookieDomain(r), host}
+	for _, d := range config.CookieDomains {
+		// Wildcard cookies are only set on the exact host
+		if !d.Wildcard {
+			domains = append(domains, d.Domain)
+		}
+	}
+
+	for _, domain := range domains {
+		if seen[domain] {
+			continue
+		}
+		seen[domain] = true
+
+		secure, sameSite := cookieAttributes(domain)
+		cookies = append(cookies, &http.Cookie{
+			Name:     config.CookieName,
+			Value:    "",
+			Path:     "/",
+			Domain:   domain,
+			HttpOnly: true,
+			Secure:   secure,
+			SameSite: sameSite,
+			Expires:  time.Now().Local().Add(time.Hour * -1),
+		})
 	}
+
+	return cookies
 }
 
 // Make a CSRF cookie (used during login only)
 func MakeCSRFCookie(r *http.Request, nonce string) *http.Cookie {
+	return makeCSRFCookie(r, nonce, 0, false)
+}
+
+// Create a csrf cookie for a login with any max age. The max age is marked in
+// the state, which the client can change, so the cookie carries a mac of it
+// to stop it being removed
+func makeCSRFCookie(r *http.Request, nonce string, maxAge time.Duration, hasMaxAge bool) *http.Cookie {
+	secure, sameSite := csrfCookieAttributes(r)
 	return &http.Cookie{
 		Name:     config.CSRFCookieName,
-		Value:    nonce,
-		Path:     "/",
+		Value:    fmt.Sprintf("%s|%s", nonce, csrfSignature(nonce, maxAge, hasMaxAge)),
+		Path:     csrfCookiePath(),
 		Domain:   csrfCookieDomain(r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   secure,
+		SameSite: sameSite,
 		Expires:  cookieExpiry(),
 	}
 }
 
 // Create a cookie to clear csrf cookie
 func ClearCSRFCookie(r *http.Request) *http.Cookie {
+	secure, sameSite := csrfCookieAttributes(r)
 	return &http.Cookie{
 		Name:     config.CSRFCookieName,
 		Value:    "",
-		Path:     "/",
+		Path:     csrfCookiePath(),
 		Domain:   csrfCookieDomain(r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   secure,
+		SameSite: sameSite,
 		Expires:  time.Now().Local().Add(time.Hour * -1),
 	}
 }
 
+// Get the number of consecutive logins that haven't resulted in a working
+// auth cookie
+func loginAttempts(r *http.Request) int {
+	c, err := r.Cookie(loginAttemptsCookieName())
+	if err != nil {
+		return 0
+	}
+
+	attempts, err := strconv.Atoi(c.Value)
+	if err != nil || attempts < 0 {
+		return 0
+	}
+
+	return attempts
+}
+
+// Make a cookie counting consecutive logins. It's read before redirecting to
+// login, so isn't scoped to the callback path like the CSRF cookie
+func MakeLoginAttemptsCookie(r *http.Request, attempts int) *http.Cookie {
+	secure, sameSite := csrfCookieAttributes(r)
+	return &http.Cookie{
+		Name:     loginAttemptsCookieName(),
+		Value:    strconv.Itoa(attempts),
+		Path:     "/",
+		Domain:   csrfCookieDomain(r),
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: sameSite,
+		Expires:  time.Now().Local().Add(loginAttemptsWindow),
+	}
+}
+
+// Create a cookie to clear the login attempts cookie
+func ClearLoginAttemptsCookie(r *http.Request) *http.Cookie {
+	c := MakeLoginAttemptsCookie(r, 0)
+	c.Value = ""
+	c.Expires = time.Now().Local().Add(time.Hour * -1)
+	return c
+}
+
+// Logins more than this far apart aren't counted as consecutive
+const loginAttemptsWindow = 5 * time.Minute
+
+func loginAttemptsCookieName() string {
+	return config.CSRFCookieName + "_attempts"
+}
+
+// The CSRF cookie is only needed by the callback, so is scoped to it rather
+// than sent with every request
+func csrfCookiePath() string {
+	if config.CSRFCookiePath != "" {
+		return config.CSRFCookiePath
+	}
+	if config.Path != "" {
+		return config.Path
+	}
+	return "/"
+}
+
+// Get the Secure and SameSite attributes for the CSRF cookie. SameSite=None
+// can't be represented by http.SameSite, so is added by SetCSRFCookie, such
+// cookies must be secure or browsers reject them
+func csrfCookieAttributes(r *http.Request) (bool, http.SameSite) {
+	secure, _ := cookieAttributes(r.Header.Get("X-Forwarded-Host"))
+	switch config.CSRFSameSite {
+	case "lax":
+		return secure, http.SameSiteLaxMode
+	case "strict":
+		return secure, http.SameSiteStrictMode
+	case "none":
+		return true, 0
+	default:
+		return secure, 0
+	}
+}
+
+// Set a CSRF cookie on the response, adding SameSite=None if configured
+func SetCSRFCookie(w http.ResponseWriter, c *http.Cookie) {
+	if config.CSRFSameSite == "none" {
+		w.Header().Add("Set-Cookie", cookieString(c)+"; SameSite=None")
+		return
+	}
+
+	SetCookie(w, c)
+}
+
+// Set a cookie, as http.SetCookie but see cookieString
+func SetCookie(w http.ResponseWriter, c *http.Cookie) {
+	if v := cookieString(c); v != "" {
+		w.Header().Add("Set-Cookie", v)
+	}
+}
+
+// Serialize a cookie for a Set-Cookie header. Go always removes a leading "."
+// from the domain, so it's added back when cookie-domain-leading-dot is set
+func cookieString(c *http.Cookie) string {
+	v := c.String()
+	if config.CookieDomainLeadingDot && c.Domain != "" && net.ParseIP(c.Domain) == nil {
+		v = strings.Replace(v, "; Domain=", "; Domain=.", 1)
+	}
+	return v
+}
+
+// Make a token for the logout confirmation form. It's derived from the auth
+// cookie, so another site can't know it
+func logoutToken(c *http.Cookie) string {
+	return logoutTokenWithSecret(config.Secret, c)
+}
+
+func logoutTokenWithSecret(secret []byte, c *http.Cookie) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("logout:"))
+	mac.Write([]byte(c.Value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Validate the token submitted with a logout. It's sent in the query string as
+// traefik doesn't forward the request body. Without an auth cookie there is
+// nothing to log out of, so no token is needed. Tokens made with any
+// validation secret are accepted, as the confirmation page may have been
+// shown by another instance
+func validLogoutToken(r *http.Request) bool {
+	c, err := r.Cookie(config.CookieName)
+	if err != nil {
+		return true
+	}
+
+	token := []byte(r.URL.Query().Get("csrf_token"))
+	for _, secret := range append([][]byte{config.Secret}, config.ValidationSecrets...) {
+		if hmac.Equal(token, []byte(logoutTokenWithSecret(secret, c))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate a redirect is to the host the request was made to, or to an
+// allowed redirect domain. Without any allowed redirect domains the cookie
+// domains and auth host are allowed
+func ValidateRedirect(r *http.Request, redirect string) bool {
+	u, err := url.Parse(redirect)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == strings.ToLower(removePort(r.Host)) {
+		return true
+	}
+
+	return config.isAllowedRedirectHost(host)
+}
+
+// Get the origin a callback was made from, this is the Origin header or, as
+// browsers don't send it for GET navigations, the Referer. Empty if the
+// browser sent neither, "null" is sent for opaque origins so treated the same
+func callbackOrigin(r *http.Request) string {
+	for _, header := range []string{"Origin", "Referer"} {
+		if origin := r.Header.Get(header); origin != "" && origin != "null" {
+			return origin
+		}
+	}
+
+	return ""
+}
+
+// Validate the origin of a callback, callbacks are made by the provider
+// redirecting (or posting) the user back to us, or from our own host
+func ValidateCallbackOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == strings.ToLower(removePort(r.Host)) {
+		return true
+	}
+
+	if login := config.Providers.Google.LoginURL; login != nil && host == strings.ToLower(login.Hostname()) {
+		return true
+	}
+
+	return false
+}
+
 // Validate the csrf cookie against state
 func ValidateCSRFCookie(r *http.Request, c *http.Cookie) (bool, string, error) {
-	state := r.URL.Query().Get("state")
+	state := callbackParams(r).Get("state")
 
-	if len(c.Value) != 32 {
+	parts := strings.Split(c.Value, "|")
+	if len(parts) != 2 || len(parts[0]) != 32 {
 		return false, "", errors.New("Invalid CSRF cookie value")
 	}
 
@@ -208,10 +821,30 @@ func ValidateCSRFCookie(r *http.Request, c *http.Cookie) (bool, string, error) {
 	}
 
 	// Check nonce match
-	if c.Value != state[:32] {
+	if parts[0] != state[:32] {
 		return false, "", errors.New("CSRF cookie does not match state")
 	}
 
+	// Check the max age in the state is the one the login was started with
+	mac, err := base64.URLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false, "", errors.New("Unable to decode CSRF cookie mac")
+	}
+
+	redirect, _ := splitState(state[33:])
+	_, maxAge, hasMaxAge := splitStateMaxAge(redirect)
+	valid := false
+	for _, secret := range append([][]byte{config.Secret}, config.ValidationSecrets...) {
+		expected, _ := base64.URLEncoding.DecodeString(csrfSignatureWithSecret(secret, parts[0], maxAge, hasMaxAge))
+		if hmac.Equal(mac, expected) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return false, "", errors.New("CSRF cookie does not match state max age")
+	}
+
 	// Valid, return redirect
 	return true, state[33:], nil
 }
@@ -245,34 +878,164 @@ func csrfCookieDomain(r *http.Request) string {
 		host = r.Header.Get("X-Forwarded-Host")
 	}
 
-	// Remove port
-	p := strings.Split(host, ":")
-	return p[0]
+	return removePort(host)
+}
+
+// Remove any port from a host, this also handles IPv6 addresses which contain
+// colons
+func removePort(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+
+	return host
 }
 
 // Return matching cookie domain if exists
 func matchCookieDomains(domain string) (bool, string) {
-	// Remove port
-	p := strings.Split(domain, ":")
+	host := removePort(domain)
 
-	for _, d := range config.CookieDomains {
-		if d.Match(p[0]) {
-			return true, d.Domain
+	match := findCookieDomain(host)
+	if match == nil {
+		return false, host
+	}
+
+	// Wildcards scope the cookie to the exact host
+	if match.Wildcard {
+		return true, host
+	}
+
+	return true, match.Domain
+}
+
+// Latest auth cookie format version, see ValidateCookie
+const cookieVersion = 1
+
+// Split the version prefix from an auth cookie value. Cookies without a
+// prefix are version 0, an unparseable prefix returns -1
+func splitCookieVersion(value string) (int, string) {
+	head := strings.SplitN(value, "|", 2)[0]
+	i := strings.Index(head, ".")
+	if i < 0 || !strings.HasPrefix(head, "v") {
+		return 0, value
+	}
+
+	version, err := strconv.Atoi(head[1:i])
+	if err != nil {
+		return -1, value
+	}
+
+	return version, value[i+1:]
+}
+
+// Marks the expiry of an auth cookie that should not be persisted
+const sessionCookieSuffix = "s"
+
+// Marks the state of a login that should not be remembered
+const sessionStatePrefix = "s:"
+
+// Prefix of the max age in the state, followed by the seconds and a ":"
+const maxAgeStatePrefix = "m"
+
+// Find the most specific cookie domain matching a host, a wildcard beats an
+// exact domain of the same length as it only matches subdomains
+func findCookieDomain(host string) *CookieDomain {
+	var match *CookieDomain
+	for i, d := range config.CookieDomains {
+		if !d.Match(host) {
+			continue
+		}
+
+		if match == nil || d.DomainLen > match.DomainLen ||
+			(d.DomainLen == match.DomainLen && d.Wildcard) {
+			match = &config.CookieDomains[i]
+		}
+	}
+
+	return match
+}
+
+// Get the Secure and SameSite attributes for cookies on a host, the matching
+// cookie domain's attributes override the global settings
+func cookieAttributes(host string) (bool, http.SameSite) {
+	secure := !config.InsecureCookie
+	var sameSite http.SameSite
+
+	if d := findCookieDomain(removePort(host)); d != nil {
+		if d.Secure != nil {
+			secure = *d.Secure
 		}
+		sameSite = d.SameSite
 	}
 
-	return false, p[0]
+	return secure, sameSite
 }
 
 // Create cookie hmac
-func cookieSignature(r *http.Request, email, expires string) string {
-	hash := hmac.New(sha256.New, config.Secret)
+// Sign the max age of a login with its nonce, the max age is empty if the
+// login has none
+func csrfSignature(nonce string, maxAge time.Duration, hasMaxAge bool) string {
+	return csrfSignatureWithSecret(config.Secret, nonce, maxAge, hasMaxAge)
+}
+
+func csrfSignatureWithSecret(secret []byte, nonce string, maxAge time.Duration, hasMaxAge bool) string {
+	hash := hmac.New(sha256.New, secret)
+	hash.Write([]byte(nonce))
+	hash.Write([]byte("|"))
+	if hasMaxAge {
+		hash.Write([]byte(strconv.FormatInt(int64(maxAge/time.Second), 10)))
+	}
+	return base64.URLEncoding.EncodeToString(hash.Sum(nil))
+}
+
+func cookieSignature(r *http.Request, email, expires, activity string) string {
+	return cookieSignatureWithSecret(config.Secret, r, email, expires, activity)
+}
+
+func cookieSignatureWithSecret(secret []byte, r *http.Request, email, expires, activity string) string {
+	hash := hmac.New(sha256.New, secret)
 	hash.Write([]byte(cookieDomain(r)))
 	hash.Write([]byte(email))
 	hash.Write([]byte(expires))
+	if activity != "" {
+		// Separate so digits can't be moved between expires and activity
+		hash.Write([]byte("|"))
+		hash.Write([]byte(activity))
+	}
+	if binding := cookieBinding(r); binding != "" {
+		hash.Write([]byte("#"))
+		hash.Write([]byte(binding))
+	}
 	return base64.URLEncoding.EncodeToString(hash.Sum(nil))
 }
 
+// Describe the client a cookie is bound to, this is part of the cookie mac
+// so isn't stored in the cookie itself. Empty when cookies aren't bound
+func cookieBinding(r *http.Request) string {
+	var parts []string
+	for _, bind := range config.BindCookieTo {
+		switch bind {
+		case "ip":
+			parts = append(parts, clientNetwork(clientIP(r)))
+		case "user-agent":
+			parts = append(parts, r.Header.Get("User-Agent"))
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+// Get the network an IP belongs to for binding, this allows clients to move
+// between nearby addresses (e.g. mobile clients) without being logged out
+func clientNetwork(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
 // Get cookie expirary
 func cookieExpiry() time.Time {
 	return time.Now().Local().Add(config.Lifetime)
@@ -280,27 +1043,42 @@ func cookieExpiry() time.Time {
 
 // Cookie Domain
 
-// Cookie Domain
+// Cookie Domain, a domain prefixed with "*." only matches subdomains and
+// scopes the cookie to the exact host
 type CookieDomain struct {
 	Domain       string `description:"TEST1"`
 	DomainLen    int    `description:"TEST2"`
 	SubDomain    string `description:"TEST3"`
 	SubDomainLen int    `description:"TEST4"`
+	Wildcard     bool
+
+	// Cookie attribute overrides, nil and zero use the global settings
+	Secure   *bool
+	SameSite http.SameSite
 }
 
 func NewCookieDomain(domain string) *CookieDomain {
+	wildcard := strings.HasPrefix(domain, "*.")
+	if wildcard {
+		domain = domain[2:]
+	}
+
+	// A leading "." is the same domain, as in a cookie's Domain attribute
+	domain = strings.TrimPrefix(domain, ".")
+
 	return &CookieDomain{
 		Domain:       domain,
 		DomainLen:    len(domain),
 		SubDomain:    fmt.Sprintf(".%s", domain),
 		SubDomainLen: len(domain) + 1,
+		Wildcard:     wildcard,
 	}
 }
 
 func (c *CookieDomain) Match(host string) bool {
 	// Exact domain match?
 	if host == c.Domain {
-		return true
+		return !c.Wildcard
 	}
 
 	// Subdomain match?
@@ -311,13 +1089,52 @@ func (c *CookieDomain) Match(host string) bool {
 	return false
 }
 
+// Cookie attributes can follow the domain, separated by ";", e.g.
+// "example.com;insecure;samesite=strict"
 func (c *CookieDomain) UnmarshalFlag(value string) error {
-	*c = *NewCookieDomain(value)
+	parts := strings.Split(value, ";")
+	*c = *NewCookieDomain(strings.TrimSpace(parts[0]))
+
+	for _, attr := range parts[1:] {
+		switch strings.ToLower(strings.TrimSpace(attr)) {
+		case "secure":
+			secure := true
+			c.Secure = &secure
+		case "insecure":
+			secure := false
+			c.Secure = &secure
+		case "samesite=lax":
+			c.SameSite = http.SameSiteLaxMode
+		case "samesite=strict":
+			c.SameSite = http.SameSiteStrictMode
+		default:
+			return fmt.Errorf("invalid cookie-domain attribute: %v", attr)
+		}
+	}
+
 	return nil
 }
 
 func (c *CookieDomain) MarshalFlag() (string, error) {
-	return c.Domain, nil
+	value := c.Domain
+	if c.Wildcard {
+		value = "*." + value
+	}
+
+	if c.Secure != nil && *c.Secure {
+		value += ";secure"
+	} else if c.Secure != nil {
+		value += ";insecure"
+	}
+
+	switch c.SameSite {
+	case http.SameSiteLaxMode:
+		value += ";samesite=lax"
+	case http.SameSiteStrictMode:
+		value += ";samesite=strict"
+	}
+
+	return value, nil
 }
 
 // Legacy support for comma separated list of cookie domains
@@ -337,7 +1154,8 @@ func (c *CookieDomains) UnmarshalFlag(value string) error {
 func (c *CookieDomains) MarshalFlag() (string, error) {
 	var domains []string
 	for _, d := range *c {
-		domains = append(domains, d.Domain)
+		domain, _ := d.MarshalFlag()
+		domains = append(domains, domain)
 	}
 	return strings.Join(domains, ","), nil
 }
@@ -2,8 +2,11 @@ package tfa
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -33,7 +36,7 @@ func TestAuthValidateCookie(t *testing.T) {
 	if assert.Error(err) {
 		assert.Equal("Invalid cookie format", err.Error())
 	}
-	c.Value = "1|2|3|4"
+	c.Value = "1|2|3|4|5"
 	_, err = ValidateCookie(r, c)
 	if assert.Error(err) {
 		assert.Equal("Invalid cookie format", err.Error())
@@ -62,6 +65,208 @@ func TestAuthValidateCookie(t *testing.T) {
 	assert.Equal("test@test.com", email, "valid request should return user email")
 }
 
+func TestAuthValidateCookieVersion(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+
+	// Should write latest version
+	c := MakeCookie(r, "test@test.com")
+	assert.True(strings.HasPrefix(c.Value, "v1."), "cookie should have version prefix")
+	_, err := ValidateCookie(r, c)
+	assert.Nil(err, "versioned cookie should be valid")
+
+	// Should write and accept unversioned cookies
+	config.CookieVersion = 0
+	c = MakeCookie(r, "test@test.com")
+	version, value := splitCookieVersion(c.Value)
+	assert.Equal(0, version, "cookie should not have version prefix")
+	assert.Equal(c.Value, value)
+	config.CookieVersion = 1
+	email, err := ValidateCookie(r, c)
+	assert.Nil(err, "unversioned cookie should be valid")
+	assert.Equal("test@test.com", email)
+
+	// Should reject unknown versions
+	c.Value = "v2." + c.Value
+	_, err = ValidateCookie(r, c)
+	if assert.Error(err) {
+		assert.Equal("Unsupported cookie version", err.Error())
+	}
+	c.Value = "vx.MQ==|2|3"
+	_, err = ValidateCookie(r, c)
+	if assert.Error(err) {
+		assert.Equal("Unsupported cookie version", err.Error())
+	}
+
+	// Should treat mac starting with "v" as unversioned
+	version, value = splitCookieVersion("vMQ==|2|test@test.com")
+	assert.Equal(0, version)
+	assert.Equal("vMQ==|2|test@test.com", value)
+}
+
+func TestAuthValidateCookieValidationSecret(t *testing.T) {
+	assert := assert.New(t)
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+
+	// Cookie issued by other cluster
+	config, _ = NewConfig([]string{"--secret=cluster-a-secret"})
+	c := MakeCookie(r, "test@test.com")
+
+	// Should reject without validation secret
+	config, _ = NewConfig([]string{"--secret=cluster-b-secret"})
+	_, err := ValidateCookie(r, c)
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie mac", err.Error())
+	}
+
+	// Should accept with validation secret
+	config, _ = NewConfig([]string{
+		"--secret=cluster-b-secret",
+		"--validation-secret=cluster-a-secret",
+	})
+	email, err := ValidateCookie(r, c)
+	assert.Nil(err, "cookie signed with validation secret should be valid")
+	assert.Equal("test@test.com", email)
+
+	// Should only sign with secret
+	c = MakeCookie(r, "test@test.com")
+	config, _ = NewConfig([]string{"--secret=cluster-a-secret"})
+	_, err = ValidateCookie(r, c)
+	assert.Error(err, "validation secret should not be used for signing")
+}
+
+func TestAuthValidateCookieIdle(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	config.SessionIdleTimeout = time.Minute
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+
+	// Should record activity
+	c := MakeCookie(r, "test@test.com")
+	parts := strings.Split(c.Value, "|")
+	assert.Len(parts, 4, "cookie should be 4 parts")
+	email, err := ValidateCookie(r, c)
+	assert.Nil(err, "valid request should not return an error")
+	assert.Equal("test@test.com", email)
+
+	// Should catch tampered activity
+	c.Value = fmt.Sprintf("%s|%s|%s|%d", parts[0], parts[1], parts[2], time.Now().Unix()+60)
+	_, err = ValidateCookie(r, c)
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie mac", err.Error())
+	}
+
+	// Should catch idle cookie
+	expires := time.Now().Add(time.Hour)
+	activity := fmt.Sprintf("%d", time.Now().Add(-2*time.Minute).Unix())
+	mac := cookieSignature(r, "test@test.com", fmt.Sprintf("%d", expires.Unix()), activity)
+	c.Value = fmt.Sprintf("%s|%d|test@test.com|%s", mac, expires.Unix(), activity)
+	_, err = ValidateCookie(r, c)
+	if assert.Error(err) {
+		assert.Equal("Cookie has been idle for too long", err.Error())
+	}
+
+	// Should accept cookie issued before idle timeout was enabled
+	config.SessionIdleTimeout = 0
+	c = MakeCookie(r, "test@test.com")
+	config.SessionIdleTimeout = time.Minute
+	_, err = ValidateCookie(r, c)
+	assert.Nil(err, "cookie without activity should be valid")
+}
+
+func TestAuthValidateCookieBinding(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--bind-cookie-to=ip,user-agent",
+	})
+	newRequest := func(ip, agent string) *http.Request {
+		r, _ := http.NewRequest("GET", "http://example.com", nil)
+		r.Header.Set("X-Forwarded-For", ip)
+		r.Header.Set("User-Agent", agent)
+		return r
+	}
+
+	c := MakeCookie(newRequest("1.2.3.4", "agent"), "test@test.com")
+
+	// Should accept same client
+	email, err := ValidateCookie(newRequest("1.2.3.4", "agent"), c)
+	assert.Nil(err, "same client should be valid")
+	assert.Equal("test@test.com", email)
+
+	// Should accept nearby IP
+	_, err = ValidateCookie(newRequest("1.2.3.200", "agent"), c)
+	assert.Nil(err, "client in same /24 should be valid")
+
+	// Should reject other network
+	_, err = ValidateCookie(newRequest("1.2.4.4", "agent"), c)
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie mac or bound to a different client", err.Error())
+	}
+
+	// Should reject other user agent
+	_, err = ValidateCookie(newRequest("1.2.3.4", "other agent"), c)
+	assert.Error(err, "different user agent should be invalid")
+
+	// Should bind IPv6 to /48
+	c = MakeCookie(newRequest("2001:db8:1::1", "agent"), "test@test.com")
+	_, err = ValidateCookie(newRequest("2001:db8:1:2::1", "agent"), c)
+	assert.Nil(err, "client in same /48 should be valid")
+	_, err = ValidateCookie(newRequest("2001:db8:2::1", "agent"), c)
+	assert.Error(err, "client in different /48 should be invalid")
+
+	// Should only bind to configured fingerprint
+	config.BindCookieTo = []string{"user-agent"}
+	c = MakeCookie(newRequest("1.2.3.4", "agent"), "test@test.com")
+	_, err = ValidateCookie(newRequest("5.6.7.8", "agent"), c)
+	assert.Nil(err, "IP should not be bound")
+
+	// Should not accept bound cookie once binding is disabled
+	config.BindCookieTo = nil
+	_, err = ValidateCookie(newRequest("1.2.3.4", "agent"), c)
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie mac", err.Error())
+	}
+}
+
+func TestAuthRefreshCookie(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+
+	// Should not refresh without idle timeout
+	c := MakeCookie(r, "test@test.com")
+	assert.Nil(RefreshCookie(r, c))
+
+	// Should not refresh recent activity
+	config.SessionIdleTimeout = time.Hour
+	c = MakeCookie(r, "test@test.com")
+	assert.Nil(RefreshCookie(r, c), "recent activity should not be refreshed")
+
+	// Should refresh old activity, keeping the original expiry
+	expires := time.Now().Add(time.Hour)
+	activity := fmt.Sprintf("%d", time.Now().Add(-10*time.Minute).Unix())
+	mac := cookieSignature(r, "test@test.com", fmt.Sprintf("%d", expires.Unix()), activity)
+	c.Value = fmt.Sprintf("%s|%d|test@test.com|%s", mac, expires.Unix(), activity)
+	refreshed := RefreshCookie(r, c)
+	if assert.NotNil(refreshed, "old activity should be refreshed") {
+		assert.Equal(expires.Unix(), refreshed.Expires.Unix(), "expiry should not change")
+		parts := strings.Split(refreshed.Value, "|")
+		assert.Equal(fmt.Sprintf("%d", time.Now().Unix()), parts[3])
+		_, err := ValidateCookie(r, refreshed)
+		assert.Nil(err, "refreshed cookie should be valid")
+	}
+
+	// Should add activity to cookies without it
+	config.SessionIdleTimeout = 0
+	c = MakeCookie(r, "test@test.com")
+	config.SessionIdleTimeout = time.Hour
+	refreshed = RefreshCookie(r, c)
+	if assert.NotNil(refreshed, "cookie without activity should be refreshed") {
+		assert.Len(strings.Split(refreshed.Value, "|"), 4)
+	}
+}
+
 func TestAuthValidateEmail(t *testing.T) {
 	assert := assert.New(t)
 	config, _ = NewConfig([]string{})
@@ -95,6 +300,121 @@ func TestAuthValidateEmail(t *testing.T) {
 	assert.True(v, "should allow user in whitelist")
 }
 
+func TestAuthValidateEmailIDN(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should match unicode email against ASCII domain
+	config, _ = NewConfig([]string{"--domain=xn--mller-kva.de"})
+	assert.True(ValidateEmail("test@müller.de"), "unicode domain should match ASCII domain")
+	assert.True(ValidateEmail("test@MÜLLER.de"), "domain should be case insensitive")
+	assert.False(ValidateEmail("test@muller.de"))
+
+	// Should match ASCII email against unicode domain
+	config, _ = NewConfig([]string{"--domain=müller.de"})
+	assert.Equal(CommaSeparatedList{"xn--mller-kva.de"}, config.Domains)
+	assert.True(ValidateEmail("test@xn--mller-kva.de"), "ASCII domain should match unicode domain")
+	assert.True(ValidateEmail("test@müller.de"))
+
+	// Should match whitelist domains
+	config, _ = NewConfig([]string{"--whitelist=test@müller.de"})
+	assert.True(ValidateEmail("test@xn--mller-kva.de"))
+	assert.False(ValidateEmail("other@xn--mller-kva.de"))
+
+	// Should normalise domains
+	assert.Equal("xn--mller-kva.de", normalizeDomain("Müller.DE"))
+	assert.Equal("example.com", normalizeDomain("Example.com"))
+	assert.Equal("test@xn--mller-kva.de", normalizeEmail("test@müller.de"))
+	assert.Equal("invalid", normalizeEmail("invalid"))
+}
+
+func TestAuthValidateCORSPreflight(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	config.CORSAllowedOrigins = []string{"https://app.example.com"}
+
+	newPreflight := func(origin string) *http.Request {
+		r, _ := http.NewRequest("OPTIONS", "http://example.com", nil)
+		r.Header.Add("Origin", origin)
+		r.Header.Add("Access-Control-Request-Method", "POST")
+		return r
+	}
+
+	// Should allow allowed origin
+	r := newPreflight("https://app.example.com")
+	assert.True(ValidateCORSPreflight(r), "preflight from allowed origin should be valid")
+
+	// Should reject other origin
+	r = newPreflight("https://evil.com")
+	assert.False(ValidateCORSPreflight(r), "preflight from other origin should not be valid")
+
+	// Should require preflight headers
+	r = newPreflight("https://app.example.com")
+	r.Header.Del("Access-Control-Request-Method")
+	assert.False(ValidateCORSPreflight(r), "options without request method should not be a preflight")
+
+	r = newPreflight("https://app.example.com")
+	r.Method = "GET"
+	assert.False(ValidateCORSPreflight(r), "only options can be a preflight")
+
+	// Should allow any origin
+	config.CORSAllowedOrigins = []string{"*"}
+	r = newPreflight("https://evil.com")
+	assert.True(ValidateCORSPreflight(r), "preflight from any origin should be valid")
+}
+
+func TestAuthClientIP(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+
+	// Should be empty without header
+	assert.Nil(clientIP(r))
+
+	// Should use last address without trusted proxies
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+	assert.Equal("10.0.0.1", clientIP(r).String())
+
+	// Should skip trusted proxies
+	config, _ = NewConfig([]string{"--trusted-proxy=10.0.0.0/8"})
+	assert.Equal("1.2.3.4", clientIP(r).String())
+
+	r.Header.Set("X-Forwarded-For", "5.6.7.8, 1.2.3.4, 10.0.0.2, 10.0.0.1")
+	assert.Equal("1.2.3.4", clientIP(r).String(), "should not skip past untrusted address")
+
+	// Should not trust an invalid address
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, invalid, 10.0.0.1")
+	assert.Nil(clientIP(r))
+
+	// Should skip configured number of proxies
+	config, _ = NewConfig([]string{"--forwarded-for-depth=1"})
+	r.Header.Set("X-Forwarded-For", "5.6.7.8, 1.2.3.4, 10.0.0.1")
+	assert.Equal("1.2.3.4", clientIP(r).String())
+	assert.Equal("1.2.3.4", sourceIP(r))
+
+	config, _ = NewConfig([]string{
+		"--forwarded-for-depth=1",
+		"--trusted-proxy=1.2.3.4",
+	})
+	assert.Equal("5.6.7.8", clientIP(r).String(), "should skip trusted proxies after depth")
+
+	// Should use first address when depth exceeds addresses
+	config, _ = NewConfig([]string{"--forwarded-for-depth=5"})
+	assert.Equal("5.6.7.8", clientIP(r).String())
+
+	// Should log empty source without address
+	r.Header.Del("X-Forwarded-For")
+	assert.Equal("", sourceIP(r))
+}
+
+func TestAuthIsBlockedIP(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--ip-blocklist=1.2.3.0/24"})
+
+	assert.True(isBlockedIP(net.ParseIP("1.2.3.4")))
+	assert.False(isBlockedIP(net.ParseIP("1.2.4.1")))
+	assert.False(isBlockedIP(nil))
+}
+
 // TODO: Split google tests out
 func TestAuthGetLoginURL(t *testing.T) {
 	assert := assert.New(t)
@@ -254,6 +574,112 @@ func TestAuthMakeCookie(t *testing.T) {
 	assert.False(c.Secure)
 }
 
+func TestAuthMakeSessionCookie(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	r, _ := http.NewRequest("GET", "http://app.example.com", nil)
+	r.Header.Add("X-Forwarded-Host", "app.example.com")
+
+	// Should not persist cookie
+	c := MakeSessionCookie(r, "test@example.com")
+	assert.True(c.Expires.IsZero(), "session cookie should not have an expiry")
+	email, err := ValidateCookie(r, c)
+	assert.Nil(err, "should generate valid cookie")
+	assert.Equal("test@example.com", email)
+
+	// Should still expire after lifetime
+	parts := strings.Split(c.Value, "|")
+	assert.True(strings.HasSuffix(parts[1], "s"), "session cookie expiry should be marked")
+	expires, _ := strconv.ParseInt(strings.TrimSuffix(parts[1], "s"), 10, 64)
+	assert.WithinDuration(time.Now().Add(config.Lifetime), time.Unix(expires, 0), 10*time.Second)
+
+	// Should not allow marker to be removed
+	c.Value = strings.Replace(c.Value, parts[1], strings.TrimSuffix(parts[1], "s"), 1)
+	_, err = ValidateCookie(r, c)
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie mac", err.Error())
+	}
+
+	// Should remain a session cookie when refreshed
+	config.SessionIdleTimeout = time.Minute
+	c = MakeSessionCookie(r, "test@example.com")
+	// Activity is always recorded with a tiny idle timeout
+	config.SessionIdleTimeout = time.Nanosecond
+	c = RefreshCookie(r, c)
+	config.SessionIdleTimeout = time.Minute
+	if assert.NotNil(c) {
+		assert.True(c.Expires.IsZero(), "refreshed session cookie should not have an expiry")
+		_, err = ValidateCookie(r, c)
+		assert.Nil(err, "should refresh valid cookie")
+	}
+}
+
+func TestAuthCookieAge(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+
+	c := MakeCookie(r, "test@example.com")
+	assert.True(cookieAge(c) < 10*time.Second, "new cookie should have no age")
+
+	c = MakeSessionCookie(r, "test@example.com")
+	config.Lifetime += time.Hour
+	assert.WithinDuration(time.Now().Add(-time.Hour), time.Now().Add(-cookieAge(c)), 10*time.Second)
+}
+
+func TestAuthCookieExpires(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+
+	// Should use the cookie expiry
+	c := MakeCookie(r, "test@example.com")
+	assert.Equal(c.Expires.Unix(), cookieExpires(c).Unix())
+
+	c = MakeSessionCookie(r, "test@example.com")
+	assert.WithinDuration(time.Now().Add(config.Lifetime), cookieExpires(c), 10*time.Second)
+
+	// Should use the idle timeout when sooner
+	config.SessionIdleTimeout = time.Hour
+	c = MakeCookie(r, "test@example.com")
+	assert.WithinDuration(time.Now().Add(time.Hour), cookieExpires(c), 10*time.Second)
+
+	config.SessionIdleTimeout = config.Lifetime + time.Hour
+	c = MakeCookie(r, "test@example.com")
+	assert.Equal(c.Expires.Unix(), cookieExpires(c).Unix())
+}
+
+func TestAuthRequestedMaxAge(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--trust-auth-max-age-header",
+		"--trusted-proxy=10.0.0.1",
+	})
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+	_, ok := requestedMaxAge(r)
+	assert.False(ok, "should require header")
+
+	r.Header.Set("X-Auth-Max-Age", "300")
+	maxAge, ok := requestedMaxAge(r)
+	assert.True(ok)
+	assert.Equal(5*time.Minute, maxAge)
+
+	r.Header.Set("X-Auth-Max-Age", "-1")
+	_, ok = requestedMaxAge(r)
+	assert.False(ok, "should reject negative max age")
+
+	r.Header.Set("X-Auth-Max-Age", "soon")
+	_, ok = requestedMaxAge(r)
+	assert.False(ok, "should reject invalid max age")
+
+	r.Header.Set("X-Auth-Max-Age", "300")
+	r.Header.Set("X-Forwarded-For", "10.0.0.2")
+	_, ok = requestedMaxAge(r)
+	assert.False(ok, "should require trusted proxy")
+}
+
 func TestAuthMakeCSRFCookie(t *testing.T) {
 	assert := assert.New(t)
 	config, _ = NewConfig([]string{})
@@ -263,6 +689,7 @@ func TestAuthMakeCSRFCookie(t *testing.T) {
 	// No cookie domain or auth url
 	c := MakeCSRFCookie(r, "12345678901234567890123456789012")
 	assert.Equal("app.example.com", c.Domain)
+	assert.Equal("/_oauth", c.Path, "csrf cookie should be scoped to callback")
 
 	// With cookie domain but no auth url
 	config = Config{
@@ -278,6 +705,46 @@ func TestAuthMakeCSRFCookie(t *testing.T) {
 	}
 	c = MakeCSRFCookie(r, "12345678901234567890123456789012")
 	assert.Equal("example.com", c.Domain)
+
+	// With cookie path
+	config = Config{
+		Path:           "/_oauth",
+		CSRFCookiePath: "/",
+	}
+	c = MakeCSRFCookie(r, "12345678901234567890123456789012")
+	assert.Equal("/", c.Path)
+}
+
+func TestAuthCSRFCookieSameSite(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--insecure-cookie"})
+	r, _ := http.NewRequest("GET", "http://app.example.com", nil)
+	r.Header.Add("X-Forwarded-Host", "app.example.com")
+
+	// Should not set SameSite by default
+	w := httptest.NewRecorder()
+	SetCSRFCookie(w, MakeCSRFCookie(r, "12345678901234567890123456789012"))
+	assert.NotContains(w.Header().Get("Set-Cookie"), "SameSite")
+	assert.NotContains(w.Header().Get("Set-Cookie"), "Secure")
+
+	// Should set lax
+	config.CSRFSameSite = "lax"
+	w = httptest.NewRecorder()
+	SetCSRFCookie(w, MakeCSRFCookie(r, "12345678901234567890123456789012"))
+	assert.Contains(w.Header().Get("Set-Cookie"), "; SameSite=Lax")
+
+	// Should set none, which must be secure
+	config.CSRFSameSite = "none"
+	w = httptest.NewRecorder()
+	SetCSRFCookie(w, MakeCSRFCookie(r, "12345678901234567890123456789012"))
+	assert.Contains(w.Header().Get("Set-Cookie"), "; Secure")
+	assert.Contains(w.Header().Get("Set-Cookie"), "; SameSite=None")
+
+	// Should clear with the same attributes
+	w = httptest.NewRecorder()
+	SetCSRFCookie(w, ClearCSRFCookie(r))
+	assert.Contains(w.Header().Get("Set-Cookie"), "; Secure")
+	assert.Contains(w.Header().Get("Set-Cookie"), "; SameSite=None")
 }
 
 func TestAuthClearCSRFCookie(t *testing.T) {
@@ -288,6 +755,199 @@ func TestAuthClearCSRFCookie(t *testing.T) {
 	if c.Value != "" {
 		t.Error("ClearCSRFCookie should create cookie with empty value")
 	}
+	if c.Path != "/_oauth" {
+		t.Error("ClearCSRFCookie should create cookie with callback path")
+	}
+}
+
+func TestAuthClearCookies(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	r, _ := http.NewRequest("GET", "http://app.example.com", nil)
+	r.Header.Add("X-Forwarded-Host", "app.example.com:8080")
+
+	// No cookie domains
+	cookies := ClearCookies(r)
+	assert.Len(cookies, 1)
+	assert.Equal("app.example.com", cookies[0].Domain)
+	assert.Equal("", cookies[0].Value)
+
+	// Should clear request host and every cookie domain
+	config.CookieDomains = []CookieDomain{
+		*NewCookieDomain("example.com"),
+		*NewCookieDomain("test.org"),
+	}
+	cookies = ClearCookies(r)
+	var domains []string
+	for _, c := range cookies {
+		assert.Equal("_forward_auth", c.Name)
+		assert.Equal("", c.Value)
+		assert.True(c.Expires.Before(time.Now()), "cookie should be expired")
+		domains = append(domains, c.Domain)
+	}
+	assert.Equal([]string{"example.com", "app.example.com", "test.org"}, domains)
+}
+
+func TestAuthLoginURLRemember(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+	r.Header.Add("X-Forwarded-Proto", "http")
+	r.Header.Add("X-Forwarded-Host", "example.com")
+	r.Header.Add("X-Forwarded-Uri", "/hello")
+
+	// Should mark session only logins in state
+	uri, err := url.Parse(getLoginURL(r, "default", "nonce", returnUrl(r), false))
+	assert.Nil(err)
+	assert.Equal("nonce:s:http://example.com/hello", uri.Query().Get("state"))
+
+	uri, err = url.Parse(getLoginURL(r, "default", "nonce", returnUrl(r), true))
+	assert.Nil(err)
+	assert.Equal("nonce:http://example.com/hello", uri.Query().Get("state"))
+
+	// Should use default
+	config.RememberMe = false
+	uri, err = url.Parse(GetLoginURL(r, "nonce"))
+	assert.Nil(err)
+	assert.Equal("nonce:s:http://example.com/hello", uri.Query().Get("state"))
+
+	// Should split state
+	redirect, remember := splitState("s:http://example.com/hello")
+	assert.Equal("http://example.com/hello", redirect)
+	assert.False(remember)
+
+	redirect, remember = splitState("http://example.com/hello")
+	assert.Equal("http://example.com/hello", redirect)
+	assert.True(remember)
+}
+
+func TestAuthLoginMaxAge(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--trust-auth-max-age-header",
+		"--trusted-proxy=10.0.0.0/8",
+		"--rule.admin.rule=PathPrefix(`/admin`)",
+		"--rule.admin.max-age=600",
+	})
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+	r.Header.Add("X-Forwarded-Proto", "http")
+	r.Header.Add("X-Forwarded-Host", "example.com")
+	r.Header.Add("X-Forwarded-Uri", "/admin")
+
+	// Should use rule max age
+	maxAge, ok := loginMaxAge(r, "admin")
+	assert.True(ok)
+	assert.Equal(600*time.Second, maxAge)
+
+	_, ok = loginMaxAge(r, "default")
+	assert.False(ok)
+
+	// Should use the smaller of header and rule max age
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+	r.Header.Set("X-Auth-Max-Age", "60")
+	maxAge, _ = loginMaxAge(r, "admin")
+	assert.Equal(60*time.Second, maxAge)
+
+	r.Header.Set("X-Auth-Max-Age", "3600")
+	maxAge, _ = loginMaxAge(r, "admin")
+	assert.Equal(600*time.Second, maxAge)
+
+	maxAge, _ = loginMaxAge(r, "default")
+	assert.Equal(3600*time.Second, maxAge)
+
+	// Should mark max age in state
+	uri, err := url.Parse(getLoginURL(r, "admin", "nonce", returnUrl(r), false))
+	assert.Nil(err)
+	assert.Equal("nonce:s:m600:http://example.com/admin", uri.Query().Get("state"))
+	assert.Equal("600", uri.Query().Get("max_age"))
+	assert.Equal("login", uri.Query().Get("prompt"))
+
+	// Should split max age from state
+	redirect, maxAge, ok := splitStateMaxAge("m600:http://example.com/admin")
+	assert.Equal("http://example.com/admin", redirect)
+	assert.Equal(600*time.Second, maxAge)
+	assert.True(ok)
+
+	redirect, _, ok = splitStateMaxAge("http://example.com/admin")
+	assert.Equal("http://example.com/admin", redirect)
+	assert.False(ok)
+
+	redirect, _, ok = splitStateMaxAge("mx:http://example.com/admin")
+	assert.Equal("mx:http://example.com/admin", redirect)
+	assert.False(ok)
+
+	// Should add login to configured prompt
+	config.Providers.Google.Prompt = "consent"
+	uri, err = url.Parse(getLoginURL(r, "admin", "nonce", returnUrl(r), false))
+	assert.Nil(err)
+	assert.Equal("consent login", uri.Query().Get("prompt"))
+
+	assert.Equal("login consent", addPrompt("login consent", "login"))
+}
+
+func TestAuthValidateRedirect(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	r, _ := http.NewRequest("GET", "http://app.example.com:8080/_oauth", nil)
+
+	// Should allow request host
+	assert.True(ValidateRedirect(r, "https://app.example.com/foo"))
+	assert.True(ValidateRedirect(r, "https://APP.example.com/foo"))
+	assert.False(ValidateRedirect(r, "https://other.example.com/foo"))
+
+	// Should reject invalid redirects
+	assert.False(ValidateRedirect(r, "/foo"))
+	assert.False(ValidateRedirect(r, "//app.example.com/foo"))
+	assert.False(ValidateRedirect(r, "javascript://app.example.com/foo"))
+	assert.False(ValidateRedirect(r, "http://%zz"))
+
+	// Should allow cookie domains and auth host by default
+	config, _ = NewConfig([]string{
+		"--cookie-domain=example.com",
+		"--auth-host=auth.test.org",
+	})
+	assert.True(ValidateRedirect(r, "https://other.example.com/foo"))
+	assert.True(ValidateRedirect(r, "https://auth.test.org/foo"))
+	assert.False(ValidateRedirect(r, "https://test.org/foo"))
+
+	// Should only allow allowed redirect domains when set
+	config, _ = NewConfig([]string{
+		"--cookie-domain=example.com",
+		"--allowed-redirect-domain=status.test.org",
+		"--allowed-redirect-domain=*.example.net",
+	})
+	assert.True(ValidateRedirect(r, "https://app.example.com/foo"), "request host should always be allowed")
+	assert.False(ValidateRedirect(r, "https://other.example.com/foo"))
+	assert.True(ValidateRedirect(r, "https://status.test.org/foo"))
+	assert.False(ValidateRedirect(r, "https://sub.status.test.org/foo"))
+	assert.True(ValidateRedirect(r, "https://sub.example.net/foo"))
+	assert.False(ValidateRedirect(r, "https://example.net/foo"))
+	assert.False(ValidateRedirect(r, "https://badexample.net/foo"))
+}
+
+func TestAuthCallbackOrigin(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	config.Providers.Google.LoginURL, _ = url.Parse("https://accounts.google.com/o/oauth2/auth")
+	r, _ := http.NewRequest("GET", "http://auth.example.com/_oauth", nil)
+
+	// Should prefer Origin to Referer
+	assert.Equal("", callbackOrigin(r))
+	r.Header.Set("Referer", "https://accounts.google.com/")
+	assert.Equal("https://accounts.google.com/", callbackOrigin(r))
+	r.Header.Set("Origin", "https://evil.com")
+	assert.Equal("https://evil.com", callbackOrigin(r))
+	r.Header.Set("Origin", "null")
+	assert.Equal("https://accounts.google.com/", callbackOrigin(r), "null origin should be ignored")
+
+	// Should allow provider and request host
+	assert.True(ValidateCallbackOrigin(r, "https://accounts.google.com"))
+	assert.True(ValidateCallbackOrigin(r, "https://accounts.google.com/o/oauth2/auth?foo=bar"))
+	assert.True(ValidateCallbackOrigin(r, "https://AUTH.example.com:8443"))
+	assert.False(ValidateCallbackOrigin(r, "https://evil.com"))
+	assert.False(ValidateCallbackOrigin(r, "https://accounts.google.com.evil.com"))
+	assert.False(ValidateCallbackOrigin(r, "javascript://accounts.google.com"))
+	assert.False(ValidateCallbackOrigin(r, "%zz"))
 }
 
 func TestAuthValidateCSRFCookie(t *testing.T) {
@@ -316,9 +976,16 @@ func TestAuthValidateCSRFCookie(t *testing.T) {
 		assert.Equal("Invalid CSRF cookie value", err.Error())
 	}
 
+	c.Value = "12345678901234567890123456789012"
+	valid, _, err = ValidateCSRFCookie(r, c)
+	assert.False(valid)
+	if assert.Error(err) {
+		assert.Equal("Invalid CSRF cookie value", err.Error(), "cookie without mac should be invalid")
+	}
+
 	// Should require valid state
 	r = newCsrfRequest("12345678901234567890123456789012:")
-	c.Value = "12345678901234567890123456789012"
+	c = MakeCSRFCookie(r, "12345678901234567890123456789012")
 	valid, _, err = ValidateCSRFCookie(r, c)
 	assert.False(valid)
 	if assert.Error(err) {
@@ -327,11 +994,84 @@ func TestAuthValidateCSRFCookie(t *testing.T) {
 
 	// Should allow valid state
 	r = newCsrfRequest("12345678901234567890123456789012:99")
-	c.Value = "12345678901234567890123456789012"
 	valid, state, err := ValidateCSRFCookie(r, c)
 	assert.True(valid, "valid request should return valid")
 	assert.Nil(err, "valid request should not return an error")
 	assert.Equal("99", state, "valid request should return correct state")
+
+	// Should require max age to match cookie
+	r = newCsrfRequest("12345678901234567890123456789012:m600:99")
+	valid, _, err = ValidateCSRFCookie(r, c)
+	assert.False(valid, "max age added to state should be invalid")
+	if assert.Error(err) {
+		assert.Equal("CSRF cookie does not match state max age", err.Error())
+	}
+
+	c = makeCSRFCookie(r, "12345678901234567890123456789012", 600*time.Second, true)
+	valid, state, err = ValidateCSRFCookie(r, c)
+	assert.True(valid, "matching max age should be valid")
+	assert.Nil(err)
+	assert.Equal("m600:99", state)
+
+	r = newCsrfRequest("12345678901234567890123456789012:99")
+	valid, _, err = ValidateCSRFCookie(r, c)
+	assert.False(valid, "max age removed from state should be invalid")
+	if assert.Error(err) {
+		assert.Equal("CSRF cookie does not match state max age", err.Error())
+	}
+
+	c.Value = "12345678901234567890123456789012|notamac"
+	valid, _, err = ValidateCSRFCookie(r, c)
+	assert.False(valid, "tampered mac should be invalid")
+}
+
+func TestAuthValidateCSRFCookieValidationSecret(t *testing.T) {
+	assert := assert.New(t)
+	r, _ := http.NewRequest("GET", "http://example.com?state=12345678901234567890123456789012:m600:99", nil)
+
+	// Login started on other cluster
+	config, _ = NewConfig([]string{"--secret=cluster-a-secret"})
+	c := makeCSRFCookie(r, "12345678901234567890123456789012", 600*time.Second, true)
+
+	// Should reject without validation secret
+	config, _ = NewConfig([]string{"--secret=cluster-b-secret"})
+	valid, _, err := ValidateCSRFCookie(r, c)
+	assert.False(valid)
+	if assert.Error(err) {
+		assert.Equal("CSRF cookie does not match state max age", err.Error())
+	}
+
+	// Should accept with validation secret
+	config, _ = NewConfig([]string{
+		"--secret=cluster-b-secret",
+		"--validation-secret=cluster-a-secret",
+	})
+	valid, state, err := ValidateCSRFCookie(r, c)
+	assert.True(valid, "CSRF cookie signed with validation secret should be valid")
+	assert.Nil(err)
+	assert.Equal("m600:99", state)
+}
+
+func TestAuthValidLogoutTokenValidationSecret(t *testing.T) {
+	assert := assert.New(t)
+	r, _ := http.NewRequest("POST", "http://example.com", nil)
+
+	// Confirmation page shown by other cluster
+	config, _ = NewConfig([]string{"--secret=cluster-a-secret"})
+	c := MakeCookie(r, "test@test.com")
+	r, _ = http.NewRequest("POST", "http://example.com/_oauth/logout?csrf_token="+url.QueryEscape(logoutToken(c)), nil)
+	r.AddCookie(c)
+
+	// Should reject without validation secret
+	config, _ = NewConfig([]string{"--secret=cluster-b-secret"})
+	assert.False(validLogoutToken(r))
+
+	// Should accept with validation secret
+	config, _ = NewConfig([]string{
+		"--secret=cluster-b-secret",
+		"--validation-secret=cluster-a-secret",
+	})
+	assert.True(validLogoutToken(r), "token made with validation secret should be valid")
 }
 
 func TestAuthNonce(t *testing.T) {
@@ -364,6 +1104,210 @@ func TestAuthCookieDomainMatch(t *testing.T) {
 	assert.False(cd.Match("test.com"), "other domain should not match")
 }
 
+func TestAuthCookieDomainLeadingDot(t *testing.T) {
+	assert := assert.New(t)
+	cd := NewCookieDomain(".example.com")
+	assert.Equal("example.com", cd.Domain, "leading dot should be removed")
+	assert.True(cd.Match("example.com"), "exact domain should match")
+	assert.True(cd.Match("test.example.com"), "subdomain should match")
+}
+
+func TestAuthSetCookieLeadingDot(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--cookie-domain=.example.com"})
+	r := httptest.NewRequest("GET", "http://app.example.com", nil)
+	r.Header.Add("X-Forwarded-Host", "app.example.com")
+
+	// Should set domain without dot by default
+	w := httptest.NewRecorder()
+	SetCookie(w, MakeCookie(r, "test@example.com"))
+	assert.Contains(w.Header().Get("Set-Cookie"), "; Domain=example.com;")
+
+	w = httptest.NewRecorder()
+	SetCSRFCookie(w, MakeCSRFCookie(r, "12345678901234567890123456789012"))
+	assert.Contains(w.Header().Get("Set-Cookie"), "; Domain=app.example.com;")
+
+	// Should set domain with dot when configured
+	config.CookieDomainLeadingDot = true
+	w = httptest.NewRecorder()
+	SetCookie(w, MakeCookie(r, "test@example.com"))
+	assert.Contains(w.Header().Get("Set-Cookie"), "; Domain=.example.com;")
+
+	w = httptest.NewRecorder()
+	SetCSRFCookie(w, MakeCSRFCookie(r, "12345678901234567890123456789012"))
+	assert.Contains(w.Header().Get("Set-Cookie"), "; Domain=.app.example.com;")
+
+	config.CSRFSameSite = "none"
+	w = httptest.NewRecorder()
+	SetCSRFCookie(w, MakeCSRFCookie(r, "12345678901234567890123456789012"))
+	assert.Contains(w.Header().Get("Set-Cookie"), "; Domain=.app.example.com;")
+	assert.Contains(w.Header().Get("Set-Cookie"), "; SameSite=None")
+
+	// Should still be a valid cookie
+	res := http.Response{Header: w.Header()}
+	if cookies := res.Cookies(); assert.Len(cookies, 1) {
+		assert.Equal(config.CSRFCookieName, cookies[0].Name)
+		assert.Equal(".app.example.com", cookies[0].Domain)
+	}
+
+	// Should not add dot to IP addresses
+	r = httptest.NewRequest("GET", "http://10.0.0.1", nil)
+	r.Header.Add("X-Forwarded-Host", "10.0.0.1")
+	w = httptest.NewRecorder()
+	SetCookie(w, MakeCookie(r, "test@example.com"))
+	assert.Contains(w.Header().Get("Set-Cookie"), "; Domain=10.0.0.1;")
+}
+
+func TestAuthCookieDomainWildcard(t *testing.T) {
+	assert := assert.New(t)
+	cd := NewCookieDomain("*.internal.example.com")
+	assert.Equal("internal.example.com", cd.Domain)
+	assert.True(cd.Wildcard)
+
+	// Exact should not match
+	assert.False(cd.Match("internal.example.com"), "exact domain should not match wildcard")
+
+	// Subdomain should match
+	assert.True(cd.Match("app.internal.example.com"), "subdomain should match wildcard")
+
+	// Parent domain should not match
+	assert.False(cd.Match("app.example.com"), "parent domain should not match wildcard")
+
+	marshal, err := cd.MarshalFlag()
+	assert.Nil(err)
+	assert.Equal("*.internal.example.com", marshal)
+}
+
+func TestAuthCookieDomainAttributes(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--cookie-domain=example.com;samesite=strict",
+		"--cookie-domain=internal.lan;insecure",
+	})
+
+	newRequest := func(host string) *http.Request {
+		r, _ := http.NewRequest("GET", "http://"+host, nil)
+		r.Header.Add("X-Forwarded-Host", host)
+		return r
+	}
+
+	// Should use domain overrides
+	c := MakeCookie(newRequest("app.example.com"), "test@example.com")
+	assert.True(c.Secure)
+	assert.Equal(http.SameSiteStrictMode, c.SameSite)
+
+	c = MakeCookie(newRequest("app.internal.lan"), "test@example.com")
+	assert.False(c.Secure, "domain override should take precedence")
+	assert.Equal(http.SameSite(0), c.SameSite)
+
+	c = MakeCSRFCookie(newRequest("app.internal.lan"), "12345678901234567890123456789012")
+	assert.False(c.Secure, "domain override should apply to csrf cookie")
+
+	// Should use global settings without matching domain
+	c = MakeCookie(newRequest("test.org"), "test@example.com")
+	assert.True(c.Secure)
+	assert.Equal(http.SameSite(0), c.SameSite)
+
+	config.InsecureCookie = true
+	c = MakeCookie(newRequest("test.org"), "test@example.com")
+	assert.False(c.Secure)
+	c = MakeCookie(newRequest("app.example.com"), "test@example.com")
+	assert.False(c.Secure, "global setting should apply without override")
+
+	// Should clear cookies with each domain's attributes
+	config.InsecureCookie = false
+	for _, c := range ClearCookies(newRequest("test.org")) {
+		switch c.Domain {
+		case "example.com":
+			assert.True(c.Secure)
+			assert.Equal(http.SameSiteStrictMode, c.SameSite)
+		case "internal.lan":
+			assert.False(c.Secure)
+		default:
+			assert.True(c.Secure)
+		}
+	}
+}
+
+func TestAuthCookieDomainFlag(t *testing.T) {
+	assert := assert.New(t)
+	d := CookieDomain{}
+
+	err := d.UnmarshalFlag("*.example.com; Secure ;samesite=lax")
+	assert.Nil(err)
+	assert.Equal("example.com", d.Domain)
+	assert.True(d.Wildcard)
+	if assert.NotNil(d.Secure) {
+		assert.True(*d.Secure)
+	}
+	assert.Equal(http.SameSiteLaxMode, d.SameSite)
+
+	marshal, err := d.MarshalFlag()
+	assert.Nil(err)
+	assert.Equal("*.example.com;secure;samesite=lax", marshal)
+
+	// Should reject unknown attributes
+	err = d.UnmarshalFlag("example.com;samesite=none")
+	if assert.Error(err) {
+		assert.Equal("invalid cookie-domain attribute: samesite=none", err.Error())
+	}
+	_, err = NewConfig([]string{"--cookie-domain=example.com;httponly"})
+	assert.Error(err, "invalid attribute should error at config load")
+}
+
+func TestAuthMatchCookieDomainsMostSpecific(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	config.CookieDomains = []CookieDomain{
+		*NewCookieDomain("example.com"),
+		*NewCookieDomain("*.internal.example.com"),
+		*NewCookieDomain("apps.example.com"),
+	}
+
+	// Should use parent domain
+	match, domain := matchCookieDomains("www.example.com")
+	assert.True(match)
+	assert.Equal("example.com", domain)
+
+	// Should use more specific parent domain
+	match, domain = matchCookieDomains("one.apps.example.com:8080")
+	assert.True(match)
+	assert.Equal("apps.example.com", domain)
+
+	// Should use exact host for wildcard
+	match, domain = matchCookieDomains("app.internal.example.com")
+	assert.True(match)
+	assert.Equal("app.internal.example.com", domain)
+
+	// Wildcard domain itself should fall back to parent domain
+	match, domain = matchCookieDomains("internal.example.com")
+	assert.True(match)
+	assert.Equal("example.com", domain)
+
+	// Wildcard should beat exact domain of the same length
+	config.CookieDomains = []CookieDomain{
+		*NewCookieDomain("internal.example.com"),
+		*NewCookieDomain("*.internal.example.com"),
+	}
+	match, domain = matchCookieDomains("app.internal.example.com")
+	assert.True(match)
+	assert.Equal("app.internal.example.com", domain)
+
+	// No match
+	match, domain = matchCookieDomains("test.org:443")
+	assert.False(match)
+	assert.Equal("test.org", domain)
+}
+
+func TestAuthRemovePort(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("app.example.com", removePort("app.example.com:8443"))
+	assert.Equal("app.example.com", removePort("app.example.com"))
+	assert.Equal("::1", removePort("[::1]:8443"))
+	assert.Equal("::1", removePort("::1"))
+	assert.Equal("", removePort(""))
+}
+
 func TestAuthCookieDomains(t *testing.T) {
 	assert := assert.New(t)
 	cds := CookieDomains{}
@@ -0,0 +1,99 @@
+package tfa
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Developer commands
+
+// Generate a valid auth cookie, args: <host> <email> [options]
+func CookieCommand(args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("usage: cookie <host> <email> [options]")
+	}
+
+	err := commandConfig(args[2:])
+	if err != nil {
+		return "", err
+	}
+
+	c := MakeCookie(commandRequest(args[0]), args[1])
+	return fmt.Sprintf("%s=%s", c.Name, c.Value), nil
+}
+
+// Explain whether an auth cookie is valid, args: <host> <cookie> [options]
+func ValidateCommand(args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("usage: validate <host> <cookie> [options]")
+	}
+
+	err := commandConfig(args[2:])
+	if err != nil {
+		return "", err
+	}
+
+	// Accept the value with or without the cookie name
+	value := strings.TrimPrefix(args[1], config.CookieName+"=")
+
+	r := commandRequest(args[0])
+	email, err := ValidateCookie(r, &http.Cookie{Name: config.CookieName, Value: value})
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, explainCookieError(err))
+	}
+
+	if !ValidateEmail(email) {
+		return "", fmt.Errorf("Invalid email: cookie is valid but %s is not permitted by \"domain\" or \"whitelist\"", email)
+	}
+
+	return fmt.Sprintf("Valid cookie for %s on cookie domain %s", email, cookieDomain(r)), nil
+}
+
+func commandConfig(args []string) error {
+	var err error
+	config, err = NewConfig(args)
+	if err != nil {
+		return err
+	}
+
+	if len(config.Secret) == 0 {
+		return errors.New("\"secret\" option must be set")
+	}
+
+	return nil
+}
+
+// Build a request as it would be forwarded by traefik
+func commandRequest(host string) *http.Request {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-Host", host)
+	return r
+}
+
+func explainCookieError(err error) string {
+	switch err.Error() {
+	case "Unsupported cookie version":
+		return fmt.Sprintf("the cookie was issued by a newer release, versions up to %d are supported", cookieVersion)
+	case "Invalid cookie format":
+		return "expected \"<mac>|<expires>|<email>\""
+	case "Unable to decode cookie mac":
+		return "the mac is not valid base64"
+	case "Invalid cookie mac":
+		return "check \"secret\" matches and the host has the same cookie domain as the host the cookie was issued for"
+	case "Invalid cookie mac or bound to a different client":
+		return "check \"secret\" matches, and the client IP and User-Agent match those the cookie was issued to"
+	case "Unable to parse cookie expiry":
+		return "the expiry is not a unix timestamp"
+	case "Cookie has expired":
+		return fmt.Sprintf("cookies are valid for %s after being issued", config.Lifetime.Round(time.Second))
+	case "Unable to parse cookie activity":
+		return "the last activity is not a unix timestamp"
+	case "Cookie has been idle for too long":
+		return fmt.Sprintf("sessions expire after %s without a request", config.SessionIdleTimeout.Round(time.Second))
+	default:
+		return "unknown error"
+	}
+}
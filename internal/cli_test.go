@@ -0,0 +1,116 @@
+package tfa
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestCliCookieCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should require host and email
+	_, err := CookieCommand([]string{"app.example.com"})
+	if assert.Error(err) {
+		assert.Equal("usage: cookie <host> <email> [options]", err.Error())
+	}
+
+	// Should require secret
+	_, err = CookieCommand([]string{"app.example.com", "test@example.com"})
+	if assert.Error(err) {
+		assert.Equal("\"secret\" option must be set", err.Error())
+	}
+
+	// Should generate a valid cookie
+	out, err := CookieCommand([]string{
+		"app.example.com", "test@example.com",
+		"--secret=0123456789abcdef",
+	})
+	require.Nil(t, err)
+	assert.True(strings.HasPrefix(out, "_forward_auth="))
+
+	r := commandRequest("app.example.com")
+	r.Header.Set("Cookie", out)
+	c, err := r.Cookie("_forward_auth")
+	require.Nil(t, err)
+	email, err := ValidateCookie(r, c)
+	assert.Nil(err, "printed cookie should be valid")
+	assert.Equal("test@example.com", email)
+
+	// Should not be valid for another host
+	_, err = ValidateCookie(commandRequest("other.example.com"), c)
+	assert.Error(err, "printed cookie should be bound to its host")
+}
+
+func TestCliValidateCommand(t *testing.T) {
+	assert := assert.New(t)
+	cookie, err := CookieCommand([]string{
+		"app.example.com", "test@example.com",
+		"--secret=0123456789abcdef",
+		"--cookie-domain=example.com",
+	})
+	require.Nil(t, err)
+
+	// Should accept cookie with or without name
+	out, err := ValidateCommand([]string{
+		"app.example.com", cookie,
+		"--secret=0123456789abcdef",
+		"--cookie-domain=example.com",
+	})
+	assert.Nil(err)
+	assert.Equal("Valid cookie for test@example.com on cookie domain example.com", out)
+
+	value := strings.SplitN(cookie, "=", 2)[1]
+	_, err = ValidateCommand([]string{
+		"other.example.com", value,
+		"--secret=0123456789abcdef",
+		"--cookie-domain=example.com",
+	})
+	assert.Nil(err, "cookie should be valid on another host in the cookie domain")
+
+	// Should explain wrong secret
+	_, err = ValidateCommand([]string{
+		"app.example.com", cookie,
+		"--secret=fedcba9876543210",
+		"--cookie-domain=example.com",
+	})
+	if assert.Error(err) {
+		assert.True(strings.HasPrefix(err.Error(), "Invalid cookie mac: check \"secret\""))
+	}
+
+	// Should explain invalid format
+	_, err = ValidateCommand([]string{
+		"app.example.com", "nope",
+		"--secret=0123456789abcdef",
+	})
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie format: expected \"<mac>|<expires>|<email>\"", err.Error())
+	}
+
+	// Should check email
+	_, err = ValidateCommand([]string{
+		"app.example.com", cookie,
+		"--secret=0123456789abcdef",
+		"--cookie-domain=example.com",
+		"--domain=test.com",
+	})
+	if assert.Error(err) {
+		assert.Equal("Invalid email: cookie is valid but test@example.com is not permitted by \"domain\" or \"whitelist\"", err.Error())
+	}
+}
+
+func TestCliExplainCookieError(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--session-idle-timeout=60"})
+
+	assert.Equal("sessions expire after 1m0s without a request", explainCookieError(errors.New("Cookie has been idle for too long")))
+	assert.Equal("the last activity is not a unix timestamp", explainCookieError(errors.New("Unable to parse cookie activity")))
+	assert.Equal("unknown error", explainCookieError(errors.New("Something else")))
+}
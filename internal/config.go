@@ -5,44 +5,110 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/thomseddon/go-flags"
 	"github.com/thomseddon/traefik-forward-auth/internal/provider"
 )
 
 var config Config
 
+// Secrets shorter than this are rejected unless explicitly allowed
+const minSecretLength = 16
+
 type Config struct {
-	LogLevel  string `long:"log-level" env:"LOG_LEVEL" default:"warn" choice:"trace" choice:"debug" choice:"info" choice:"warn" choice:"error" choice:"fatal" choice:"panic" description:"Log level"`
-	LogFormat string `long:"log-format"  env:"LOG_FORMAT" default:"text" choice:"text" choice:"json" choice:"pretty" description:"Log format"`
-
-	AuthHost       string               `long:"auth-host" env:"AUTH_HOST" description:"Single host to use when returning from 3rd party auth"`
-	Config         func(s string) error `long:"config" env:"CONFIG" description:"Path to config file" json:"-"`
-	CookieDomains  []CookieDomain       `long:"cookie-domain" env:"COOKIE_DOMAIN" description:"Domain to set auth cookie on, can be set multiple times"`
-	InsecureCookie bool                 `long:"insecure-cookie" env:"INSECURE_COOKIE" description:"Use insecure cookies"`
-	CookieName     string               `long:"cookie-name" env:"COOKIE_NAME" default:"_forward_auth" description:"Cookie Name"`
-	CSRFCookieName string               `long:"csrf-cookie-name" env:"CSRF_COOKIE_NAME" default:"_forward_auth_csrf" description:"CSRF Cookie Name"`
-	DefaultAction  string               `long:"default-action" env:"DEFAULT_ACTION" default:"auth" choice:"auth" choice:"allow" description:"Default action"`
-	Domains        CommaSeparatedList   `long:"domain" env:"DOMAIN" description:"Only allow given email domains, can be set multiple times"`
-	LifetimeString int                  `long:"lifetime" env:"LIFETIME" default:"43200" description:"Lifetime in seconds"`
-	Path           string               `long:"url-path" env:"URL_PATH" default:"/_oauth" description:"Callback URL Path"`
-	SecretString   string               `long:"secret" env:"SECRET" description:"Secret used for signing (required)" json:"-"`
-	Whitelist      CommaSeparatedList   `long:"whitelist" env:"WHITELIST" description:"Only allow given email addresses, can be set multiple times"`
+	LogLevel         string             `long:"log-level" env:"LOG_LEVEL" default:"warn" choice:"trace" choice:"debug" choice:"info" choice:"warn" choice:"error" choice:"fatal" choice:"panic" description:"Log level"`
+	LogFormat        string             `long:"log-format"  env:"LOG_FORMAT" default:"text" choice:"text" choice:"json" choice:"pretty" description:"Log format"`
+	LogEmailMode     string             `long:"log-email-mode" env:"LOG_EMAIL_MODE" default:"full" choice:"full" choice:"hashed" choice:"masked" description:"How user emails are written to logs"`
+	LogRedactHeaders CommaSeparatedList `long:"log-redact-header" env:"LOG_REDACT_HEADER" description:"Request header to redact when logging, in addition to Authorization, Cookie and Proxy-Authorization, can be set multiple times"`
+
+	AllowForwardUser          bool                 `long:"allow-forward-user" env:"ALLOW_FORWARD_USER" description:"Set X-Forwarded-User on requests allowed without auth when they have a valid auth cookie"`
+	AllowWeakSecret           bool                 `long:"allow-weak-secret" env:"ALLOW_WEAK_SECRET" description:"Allow a secret shorter than 16 bytes, do not use in production"`
+	AllowCountries            CommaSeparatedList   `long:"allow-country" env:"ALLOW_COUNTRY" description:"Only allow clients located in the given country (ISO 3166-1 alpha-2 code) by the geoip-db, can be set multiple times"`
+	AllowedRedirectDomains    CommaSeparatedList   `long:"allowed-redirect-domain" env:"ALLOWED_REDIRECT_DOMAIN" description:"Domain that may be redirected to after login, prefix with \"*.\" to allow subdomains, can be set multiple times (default: cookie domains and auth host)"`
+	AuthExpiresHeader         bool                 `long:"auth-expires-header" env:"AUTH_EXPIRES_HEADER" description:"Set X-Auth-Expires to when the session expires, in seconds since the epoch, on authenticated requests"`
+	AuthFailureLimit          int                  `long:"auth-failure-limit" env:"AUTH_FAILURE_LIMIT" default:"0" description:"Reject logins with a 429 from an email or client IP with this many failed authentications within the auth-failure-window, 0 to disable"`
+	AuthFailureWindowString   int                  `long:"auth-failure-window" env:"AUTH_FAILURE_WINDOW" default:"900" description:"Window in seconds that failed authentications are counted over"`
+	AuthHost                  string               `long:"auth-host" env:"AUTH_HOST" description:"Single host to use when returning from 3rd party auth"`
+	AuthResponseHeaders       CommaSeparatedList   `long:"auth-response-header" env:"AUTH_RESPONSE_HEADER" description:"Additional header to keep on responses allowing a request, all others are removed, can be set multiple times"`
+	BindCookieTo              CommaSeparatedList   `long:"bind-cookie-to" env:"BIND_COOKIE_TO" description:"Bind auth cookies to the client, comma separated list of \"ip\" (the /24 or /48 network) and \"user-agent\""`
+	CallbackReuseSession      bool                 `long:"callback-reuse-session" env:"CALLBACK_REUSE_SESSION" description:"Redirect a failed callback using an existing valid session, e.g. one repeated with the back button, rather than showing an error"`
+	CheckCallbackOrigin       bool                 `long:"check-callback-origin" env:"CHECK_CALLBACK_ORIGIN" description:"Reject callbacks with an Origin or Referer other than the provider or this host, in addition to checking the CSRF cookie"`
+	Config                    func(s string) error `long:"config" env:"CONFIG" description:"Path to config file" json:"-"`
+	CopyRequestHeaders        CommaSeparatedList   `long:"copy-request-header" env:"COPY_REQUEST_HEADER" description:"Request header to copy onto responses allowing a request, so traefik passes it on to the upstream, can be set multiple times"`
+	CookieDomainLeadingDot    bool                 `long:"cookie-domain-leading-dot" env:"COOKIE_DOMAIN_LEADING_DOT" description:"Prefix the Domain attribute of cookies with a \".\", for old clients that only accept this form"`
+	CookieDomains             []CookieDomain       `long:"cookie-domain" env:"COOKIE_DOMAIN" description:"Domain to set auth cookie on, can be set multiple times"`
+	InsecureCookie            bool                 `long:"insecure-cookie" env:"INSECURE_COOKIE" description:"Use insecure cookies"`
+	CookieName                string               `long:"cookie-name" env:"COOKIE_NAME" default:"_forward_auth" description:"Cookie Name"`
+	CookieVersion             int                  `long:"cookie-version" env:"COOKIE_VERSION" default:"1" description:"Auth cookie format version to write, use 0 while upgrading from a release without versioned cookies"`
+	CORSAllowedOrigins        CommaSeparatedList   `long:"cors-allowed-origin" env:"CORS_ALLOWED_ORIGIN" description:"Origin allowed to make CORS preflight requests, or \"*\" for any, can be set multiple times"`
+	CORSPreflight             bool                 `long:"cors-preflight" env:"CORS_PREFLIGHT" description:"Allow CORS preflight requests from allowed origins without authentication"`
+	CSRFCookieName            string               `long:"csrf-cookie-name" env:"CSRF_COOKIE_NAME" default:"_forward_auth_csrf" description:"CSRF Cookie Name"`
+	CSRFCookiePath            string               `long:"csrf-cookie-path" env:"CSRF_COOKIE_PATH" description:"Path of the CSRF cookie, must include the url-path (default: url-path)"`
+	CSRFSameSite              string               `long:"csrf-samesite" env:"CSRF_SAMESITE" default:"default" choice:"default" choice:"lax" choice:"strict" choice:"none" description:"SameSite attribute of the CSRF cookie, \"none\" also makes the cookie secure"`
+	DefaultAction             string               `long:"default-action" env:"DEFAULT_ACTION" default:"auth" choice:"auth" choice:"allow" description:"Default action"`
+	DefaultProvider           string               `long:"default-provider" env:"DEFAULT_PROVIDER" default:"google" choice:"google" description:"Default provider"`
+	DirectAccess              string               `long:"direct-access" env:"DIRECT_ACCESS" default:"auth" choice:"auth" choice:"info" choice:"not-found" description:"Response to requests made directly, rather than via traefik, that have no X-Forwarded-Host or X-Forwarded-Uri"`
+	DenyCountries             CommaSeparatedList   `long:"deny-country" env:"DENY_COUNTRY" description:"Deny clients located in the given country (ISO 3166-1 alpha-2 code) by the geoip-db, can be set multiple times"`
+	Domains                   CommaSeparatedList   `long:"domain" env:"DOMAIN" description:"Only allow given email domains, can be set multiple times"`
+	FailOnAllowAll            bool                 `long:"fail-on-allow-all" env:"FAIL_ON_ALLOW_ALL" description:"Fail to start, rather than warn, when the default action is allow and no rules require auth"`
+	Favicon                   string               `long:"favicon" env:"FAVICON" description:"Answer /favicon.ico requests to the auth host without auth, either \"default\" for a blank icon or the path to an icon file"`
+	ForwardedForDepth         int                  `long:"forwarded-for-depth" env:"FORWARDED_FOR_DEPTH" default:"0" description:"Number of proxies in front of traefik that append to X-Forwarded-For, these are skipped when finding the client IP"`
+	GeoIPDBPath               string               `long:"geoip-db" env:"GEOIP_DB" description:"Path to a MaxMind format GeoIP country database, used by allow-country and deny-country"`
+	IPBlocklist               []IPNetwork          `long:"ip-blocklist" env:"IP_BLOCKLIST" env-delim:"," description:"IP address or network (in CIDR notation) to deny before authentication, can be set multiple times"`
+	LifetimeString            int                  `long:"lifetime" env:"LIFETIME" default:"43200" description:"Lifetime in seconds"`
+	LoginPagePath             string               `long:"login-page-template" env:"LOGIN_PAGE_TEMPLATE" description:"Path to template for a login page shown before redirecting to the provider"`
+	LogoutRequirePost         bool                 `long:"logout-require-post" env:"LOGOUT_REQUIRE_POST" description:"Require logout requests to be a POST, GET requests are shown a confirmation page"`
+	Maintenance               bool                 `long:"maintenance" env:"MAINTENANCE" description:"Show a maintenance page rather than signing users in, users with a session are unaffected, can be changed by reloading with SIGHUP"`
+	MaintenancePagePath       string               `long:"maintenance-page" env:"MAINTENANCE_PAGE" description:"Path to the HTML page shown in maintenance mode"`
+	MaintenanceRetryAfter     int                  `long:"maintenance-retry-after" env:"MAINTENANCE_RETRY_AFTER" default:"300" description:"Seconds sent in the Retry-After header in maintenance mode"`
+	MaxConcurrent             int                  `long:"max-concurrent" env:"MAX_CONCURRENT" default:"0" description:"Maximum number of requests handled at once, further requests are rejected with a 503, 0 for no limit"`
+	MaxHeaderBytes            int                  `long:"max-header-bytes" env:"MAX_HEADER_BYTES" default:"1048576" description:"Maximum size of request headers in bytes, larger requests are rejected with a 431"`
+	MaxLoginAttempts          int                  `long:"max-login-attempts" env:"MAX_LOGIN_ATTEMPTS" default:"5" description:"Show an error rather than redirecting to login after this many consecutive logins without the auth cookie being kept, 0 to disable"`
+	MaxRules                  int                  `long:"max-rules" env:"MAX_RULES" default:"10000" description:"Maximum number of rules that may be defined, 0 for no limit"`
+	Path                      string               `long:"url-path" env:"URL_PATH" default:"/_oauth" description:"Callback URL Path"`
+	RememberMeDefault         string               `long:"remember-me-default" env:"REMEMBER_ME_DEFAULT" default:"true" choice:"true" choice:"false" description:"Whether logins set a persistent cookie, rather than one cleared when the browser is closed, unless the user chooses otherwise"`
+	RequireForwardedHeaders   bool                 `long:"require-forwarded-headers" env:"REQUIRE_FORWARDED_HEADERS" description:"Reject requests missing X-Forwarded-Host or X-Forwarded-Uri with a 400, rather than treating the path as \"/\""`
+	RequireHTTPS              bool                 `long:"require-https" env:"REQUIRE_HTTPS" description:"Never authenticate plaintext requests, GET and HEAD requests are redirected to https and others are rejected with a 403"`
+	SessionIdleTimeoutString  int                  `long:"session-idle-timeout" env:"SESSION_IDLE_TIMEOUT" default:"0" description:"Expire sessions after this many seconds without a request, 0 to disable"`
+	SecretString              string               `long:"secret" env:"SECRET" description:"Secret used for signing (required)" json:"-"`
+	SkipAuthUserAgents        []string             `long:"skip-auth-user-agent" env:"SKIP_AUTH_USER_AGENT" env-delim:"\n" description:"User-Agent allowed without authentication, either an exact match or a regular expression between slashes (e.g. \"/^kube-probe\\/.*$/\"), can be set multiple times"`
+	TrustAuthMaxAgeHeader     bool                 `long:"trust-auth-max-age-header" env:"TRUST_AUTH_MAX_AGE_HEADER" description:"Require a new login for sessions older than X-Auth-Max-Age seconds when set by a trusted proxy"`
+	TrustForwardedUserHeader  bool                 `long:"trust-forwarded-user-header" env:"TRUST_FORWARDED_USER_HEADER" description:"Accept X-Forwarded-User set by a trusted proxy as authenticated"`
+	TrustedProxies            []IPNetwork          `long:"trusted-proxy" env:"TRUSTED_PROXY" env-delim:"," description:"IP address or network (in CIDR notation) of a trusted proxy, can be set multiple times"`
+	ValidationSecretStrings   []string             `long:"validation-secret" env:"VALIDATION_SECRET" env-delim:"," description:"Additional secret accepted when validating cookies, but never used for signing, can be set multiple times" json:"-"`
+	WebsocketNoRedirectString string               `long:"websocket-no-redirect" env:"WEBSOCKET_NO_REDIRECT" default:"true" choice:"true" choice:"false" description:"Respond to unauthenticated WebSocket upgrade requests with a 401, rather than a redirect to login"`
+	Whitelist                 CommaSeparatedList   `long:"whitelist" env:"WHITELIST" description:"Only allow given email addresses, can be set multiple times"`
 
 	Providers provider.Providers `group:"providers" namespace:"providers" env-namespace:"PROVIDERS"`
-	Rules     map[string]*Rule   `long:"rules.<name>.<param>" description:"Rule definitions, param can be: \"action\" or \"rule\""`
+	Rules     map[string]*Rule   `long:"rules.<name>.<param>" description:"Rule definitions, param can be: \"action\", \"rule\", \"provider\", \"post-login-redirect\", \"logout-redirect\", \"max-age\" or \"priority\""`
 
 	// Filled during transformations
-	Secret   []byte `json:"-"`
-	Lifetime time.Duration
+	Secret                    []byte   `json:"-"`
+	ValidationSecrets         [][]byte `json:"-"`
+	Lifetime                  time.Duration
+	AuthFailureWindow         time.Duration
+	SessionIdleTimeout        time.Duration
+	RememberMe                bool
+	WebsocketNoRedirect       bool
+	LoginPageTemplate         *template.Template `json:"-"`
+	FaviconData               []byte             `json:"-"`
+	MaintenancePage           []byte             `json:"-"`
+	SkipAuthUserAgentMatchers []*regexp.Regexp   `json:"-"`
+	GeoIP                     countryLookup      `json:"-"`
 
 	// Legacy
 	CookieDomainsLegacy CookieDomains `long:"cookie-domains" env:"COOKIE_DOMAINS" description:"DEPRECATED - Use \"cookie-domain\""`
@@ -125,12 +191,169 @@ func NewConfig(args []string) (Config, error) {
 		c.CookieDomains = append(c.CookieDomains, c.CookieDomainsLegacy...)
 	}
 
+	if c.CORSPreflight && len(c.CORSAllowedOrigins) == 0 {
+		return c, errors.New("cors-preflight requires at least one cors-allowed-origin")
+	}
+	for _, origin := range c.CORSAllowedOrigins {
+		err = validateOrigin(origin)
+		if err != nil {
+			return c, err
+		}
+	}
+
+	// Normalise domains so they can be compared with user emails
+	for i, domain := range c.Domains {
+		c.Domains[i] = normalizeDomain(domain)
+	}
+	for i, email := range c.Whitelist {
+		c.Whitelist[i] = normalizeEmail(email)
+	}
+
+	for _, domain := range c.AllowedRedirectDomains {
+		if err := validateRedirectDomain(domain); err != nil {
+			return c, err
+		}
+	}
+
+	// Unlike other redirects, a logout-redirect isn't given by the request so
+	// can be checked against the allowed redirect domains here. Without any,
+	// only the host logged out from is allowed, so it's checked at logout
+	if len(c.AllowedRedirectDomains) > 0 || len(c.CookieDomains) > 0 || c.AuthHost != "" {
+		for _, name := range c.orderedRuleNames() {
+			redirect := c.Rules[name].LogoutRedirect
+			if redirect == "" {
+				continue
+			}
+
+			u, err := url.Parse(redirect)
+			if err == nil && u.Host != "" && !c.isAllowedRedirectHost(u.Hostname()) {
+				return c, fmt.Errorf("rule %v logout-redirect is not to an allowed redirect domain: %v", name, redirect)
+			}
+		}
+	}
+
+	for _, bind := range c.BindCookieTo {
+		if bind != "ip" && bind != "user-agent" {
+			return c, fmt.Errorf("invalid bind-cookie-to: %v, must be \"ip\" or \"user-agent\"", bind)
+		}
+	}
+
+	for _, name := range c.CopyRequestHeaders {
+		if err := c.validateCopyRequestHeader(name); err != nil {
+			return c, err
+		}
+	}
+
+	if c.CookieVersion < 0 || c.CookieVersion > cookieVersion {
+		return c, fmt.Errorf("cookie-version must be between 0 and %d", cookieVersion)
+	}
+
+	if len(c.AllowCountries) > 0 && len(c.DenyCountries) > 0 {
+		return c, errors.New("allow-country and deny-country cannot be used together")
+	}
+
+	if (len(c.AllowCountries) > 0 || len(c.DenyCountries) > 0) && c.GeoIPDBPath == "" {
+		return c, errors.New("allow-country and deny-country require a geoip-db")
+	}
+
+	if c.AuthFailureLimit < 0 {
+		return c, errors.New("auth-failure-limit must not be negative")
+	}
+
+	if c.AuthFailureLimit > 0 && c.AuthFailureWindowString <= 0 {
+		return c, errors.New("auth-failure-window must be positive")
+	}
+
+	if c.MaxLoginAttempts < 0 {
+		return c, errors.New("max-login-attempts must not be negative")
+	}
+
+	if c.MaxHeaderBytes <= 0 {
+		return c, errors.New("max-header-bytes must be greater than 0")
+	}
+
+	if c.MaxRules > 0 && len(c.Rules) > c.MaxRules {
+		return c, fmt.Errorf("too many rules: %d rules defined, max-rules is %d", len(c.Rules), c.MaxRules)
+	}
+
+	if c.ForwardedForDepth < 0 {
+		return c, errors.New("forwarded-for-depth must not be negative")
+	}
+
+	if c.TrustAuthMaxAgeHeader && len(c.TrustedProxies) == 0 {
+		return c, errors.New("trust-auth-max-age-header requires at least one trusted-proxy")
+	}
+
+	if c.TrustForwardedUserHeader && len(c.TrustedProxies) == 0 {
+		return c, errors.New("trust-forwarded-user-header requires at least one trusted-proxy")
+	}
+
 	// Transformations
+	for _, rule := range c.Rules {
+		if rule.Provider == "" {
+			rule.Provider = c.DefaultProvider
+		}
+	}
+	if !c.Providers.Exists(c.DefaultProvider) {
+		return c, fmt.Errorf("unknown default-provider: %v", c.DefaultProvider)
+	}
+	for _, name := range c.orderedRuleNames() {
+		if p := c.Rules[name].Provider; !c.Providers.Exists(p) {
+			return c, fmt.Errorf("rule %v uses unknown provider: %v", name, p)
+		}
+	}
 	if len(c.Path) > 0 && c.Path[0] != '/' {
 		c.Path = "/" + c.Path
 	}
+	if c.CSRFCookiePath != "" && !cookiePathMatches(c.CSRFCookiePath, c.Path) {
+		return c, fmt.Errorf("csrf-cookie-path %v must include url-path %v", c.CSRFCookiePath, c.Path)
+	}
 	c.Secret = []byte(c.SecretString)
+	for _, secret := range c.ValidationSecretStrings {
+		c.ValidationSecrets = append(c.ValidationSecrets, []byte(secret))
+	}
 	c.Lifetime = time.Second * time.Duration(c.LifetimeString)
+	c.AuthFailureWindow = time.Second * time.Duration(c.AuthFailureWindowString)
+	c.SessionIdleTimeout = time.Second * time.Duration(c.SessionIdleTimeoutString)
+	c.RememberMe = c.RememberMeDefault == "true"
+	c.WebsocketNoRedirect = c.WebsocketNoRedirectString == "true"
+	for _, agent := range c.SkipAuthUserAgents {
+		matcher, err := compileUserAgent(agent)
+		if err != nil {
+			return c, err
+		}
+		c.SkipAuthUserAgentMatchers = append(c.SkipAuthUserAgentMatchers, matcher)
+	}
+	err = c.Providers.Google.Setup()
+	if err != nil {
+		return c, err
+	}
+	if c.GeoIPDBPath != "" {
+		c.GeoIP, err = openGeoIPDatabase(c.GeoIPDBPath)
+		if err != nil {
+			return c, fmt.Errorf("unable to open geoip-db: %v", err)
+		}
+	}
+	if c.LoginPagePath != "" {
+		c.LoginPageTemplate, err = template.ParseFiles(c.LoginPagePath)
+		if err != nil {
+			return c, err
+		}
+	}
+	if c.Favicon == "default" {
+		c.FaviconData = defaultFavicon
+	} else if c.Favicon != "" {
+		c.FaviconData, err = ioutil.ReadFile(c.Favicon)
+		if err != nil {
+			return c, fmt.Errorf("unable to read favicon: %v", err)
+		}
+	}
+	if c.MaintenancePagePath != "" {
+		c.MaintenancePage, err = ioutil.ReadFile(c.MaintenancePagePath)
+		if err != nil {
+			return c, fmt.Errorf("unable to read maintenance-page: %v", err)
+		}
+	}
 
 	return c, nil
 }
@@ -141,6 +364,16 @@ func (c *Config) parseFlags(args []string) error {
 
 	i := flags.NewIniParser(p)
 	c.Config = func(s string) error {
+		// Convert json to ini, so it's parsed in the same way
+		if strings.ToLower(filepath.Ext(s)) == ".json" {
+			converted, err := convertJSONToIni(s)
+			if err != nil {
+				return err
+			}
+
+			return i.Parse(converted)
+		}
+
 		// Try parsing at as an ini
 		err := i.ParseFile(s)
 
@@ -213,6 +446,22 @@ func (c *Config) parseUnknownFlag(option string, arg flags.SplitArgument, args [
 			rule.Rule = val
 		case "provider":
 			rule.Provider = val
+		case "post-login-redirect":
+			rule.PostLoginRedirect = val
+		case "logout-redirect":
+			rule.LogoutRedirect = val
+		case "max-age":
+			maxAge, err := strconv.Atoi(val)
+			if err != nil || maxAge <= 0 {
+				return args, fmt.Errorf("invalid rule max-age: %v, must be a positive number of seconds", val)
+			}
+			rule.MaxAge = maxAge
+		case "priority":
+			priority, err := strconv.Atoi(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid rule priority: %v, must be a number", val)
+			}
+			rule.Priority = priority
 		default:
 			return args, fmt.Errorf("inavlid route param: %v", option)
 		}
@@ -223,6 +472,133 @@ func (c *Config) parseUnknownFlag(option string, arg flags.SplitArgument, args [
 	return args, nil
 }
 
+// An origin must be "*" or a scheme and host, e.g. "https://example.com"
+func validateOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("invalid cors-allowed-origin: %v", origin)
+	}
+
+	return nil
+}
+
+// User-Agents of common browsers, a skip-auth-user-agent must not match any
+// of these as it would allow almost anyone without authentication
+var browserUserAgents = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15",
+	"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1",
+	"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0",
+}
+
+// A skip-auth-user-agent is an exact match, or a regular expression when
+// wrapped in slashes. Either way it must not match a browser
+func compileUserAgent(agent string) (*regexp.Regexp, error) {
+	if agent == "" {
+		return nil, errors.New("skip-auth-user-agent must not be empty")
+	}
+
+	var matcher *regexp.Regexp
+	if len(agent) > 1 && strings.HasPrefix(agent, "/") && strings.HasSuffix(agent, "/") {
+		var err error
+		matcher, err = regexp.Compile(agent[1 : len(agent)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid skip-auth-user-agent %v: %v", agent, err)
+		}
+	} else {
+		matcher = regexp.MustCompile("^" + regexp.QuoteMeta(agent) + "$")
+	}
+
+	for _, browser := range append(browserUserAgents, "") {
+		if matcher.MatchString(browser) {
+			return nil, fmt.Errorf("skip-auth-user-agent %v is too broad, it matches browsers or requests without a User-Agent", agent)
+		}
+	}
+
+	return matcher, nil
+}
+
+// Headers that must never be copied from a request onto the response, as they
+// carry credentials or would let the client choose who they are
+var uncopyableHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie", "X-Forwarded-User"}
+
+// A copy-request-header must not be sensitive, headers redacted from logs are
+// treated as sensitive too
+func (c *Config) validateCopyRequestHeader(name string) error {
+	if name == "" {
+		return errors.New("copy-request-header must not be empty")
+	}
+
+	for _, names := range [][]string{uncopyableHeaders, c.LogRedactHeaders} {
+		for _, sensitive := range names {
+			if http.CanonicalHeaderKey(sensitive) == http.CanonicalHeaderKey(name) {
+				return fmt.Errorf("copy-request-header %v is not allowed, it may contain credentials", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Check a cookie with the given path is sent with requests to the request
+// path (RFC 6265 5.1.4)
+func cookiePathMatches(cookiePath, requestPath string) bool {
+	if cookiePath == requestPath {
+		return true
+	}
+
+	return strings.HasPrefix(requestPath, strings.TrimSuffix(cookiePath, "/")+"/")
+}
+
+// A redirect domain must be a host, optionally prefixed with "*."
+func validateRedirectDomain(domain string) error {
+	host := strings.TrimPrefix(domain, "*.")
+	if host == "" || strings.ContainsAny(host, "*/:@ ") {
+		return fmt.Errorf("invalid allowed-redirect-domain: %v", domain)
+	}
+
+	return nil
+}
+
+// Is a redirect to the host allowed by allowed-redirect-domain or, without
+// any allowed redirect domains, a cookie domain or the auth host
+func (c *Config) isAllowedRedirectHost(host string) bool {
+	host = strings.ToLower(host)
+	if len(c.AllowedRedirectDomains) > 0 {
+		for _, domain := range c.AllowedRedirectDomains {
+			domain = strings.ToLower(domain)
+			if strings.HasPrefix(domain, "*.") {
+				if strings.HasSuffix(host, domain[1:]) {
+					return true
+				}
+			} else if host == domain {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if c.AuthHost != "" && host == strings.ToLower(removePort(c.AuthHost)) {
+		return true
+	}
+
+	for _, d := range c.CookieDomains {
+		if d.Match(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func handlFlagError(err error) error {
 	flagsErr, ok := err.(*flags.Error)
 	if ok && flagsErr.Type == flags.ErrHelp {
@@ -244,13 +620,90 @@ func convertLegacyToIni(name string) (io.Reader, error) {
 	return bytes.NewReader(legacyFileFormat.ReplaceAll(b, []byte("$1=$2"))), nil
 }
 
+// Convert a json config file to ini, nested objects are joined with "." so
+// {"providers": {"google": {"client-id": "id"}}} becomes
+// providers.google.client-id="id", arrays set an option multiple times
+func convertJSONToIni(name string) (io.Reader, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	err = d.Decode(&values)
+	if err != nil {
+		return nil, fmt.Errorf("invalid json config file %s: %v", name, err)
+	}
+
+	var ini bytes.Buffer
+	err = writeJSONIni(&ini, "", values)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ini, nil
+}
+
+func writeJSONIni(ini *bytes.Buffer, key string, value interface{}) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			name := k
+			if key != "" {
+				name = key + "." + k
+			}
+			err := writeJSONIni(ini, name, v[k])
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				return fmt.Errorf("invalid json config value for %s: arrays may only contain strings, numbers or booleans", key)
+			}
+			err := writeJSONIni(ini, key, item)
+			if err != nil {
+				return err
+			}
+		}
+	case string:
+		fmt.Fprintf(ini, "%s=%s\n", key, strconv.Quote(v))
+	case json.Number, bool:
+		fmt.Fprintf(ini, "%s=%v\n", key, v)
+	}
+
+	return nil
+}
+
 func (c *Config) Validate() {
 	// Check for show stopper errors
 	if len(c.Secret) == 0 {
 		log.Fatal("\"secret\" option must be set.")
 	}
 
-	if c.Providers.Google.ClientId == "" || c.Providers.Google.ClientSecret == "" {
+	if len(c.Secret) < minSecretLength && !c.AllowWeakSecret {
+		log.Fatalf("\"secret\" option must be at least %d bytes, use \"allow-weak-secret\" to override", minSecretLength)
+	}
+
+	for _, secret := range c.ValidationSecrets {
+		if len(secret) < minSecretLength && !c.AllowWeakSecret {
+			log.Fatalf("\"validation-secret\" options must be at least %d bytes, use \"allow-weak-secret\" to override", minSecretLength)
+		}
+	}
+
+	// The secret isn't used when authenticating with a client assertion
+	needsSecret := c.Providers.Google.TokenAuthMethod != "private_key_jwt"
+	if c.Providers.Google.ClientId == "" || (needsSecret && c.Providers.Google.ClientSecret == "") {
 		log.Fatal("providers.google.client-id, providers.google.client-secret must be set")
 	}
 
@@ -258,26 +711,122 @@ func (c *Config) Validate() {
 	for _, rule := range c.Rules {
 		rule.Validate()
 	}
+
+	// Check something requires auth, this is usually a mistake
+	if c.allowsAll() {
+		if c.FailOnAllowAll {
+			log.Fatal("default-action is allow and no rules require auth, so all requests would be allowed without authentication")
+		}
+		log.Warn("default-action is allow and no rules require auth, all requests will be allowed without authentication")
+	}
 }
 
+// Get the header limit for the http server, this is well above max-header-bytes
+// so larger requests reach RootHandler, which rejects and logs them, rather
+// than being rejected by the server without a log
+func (c *Config) ServerMaxHeaderBytes() int {
+	limit := 2 * c.MaxHeaderBytes
+	if limit < http.DefaultMaxHeaderBytes {
+		limit = http.DefaultMaxHeaderBytes
+	}
+
+	return limit
+}
+
+// Would every request be allowed without authentication
+func (c *Config) allowsAll() bool {
+	if c.DefaultAction != "allow" {
+		return false
+	}
+
+	for _, rule := range c.Rules {
+		if rule.Action != "allow" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Secrets are left out by their json tags, but a proxy URL may also contain
+// a password
 func (c Config) String() string {
+	c.Providers.Google.HTTPProxy = redactURLPassword(c.Providers.Google.HTTPProxy)
 	jsonConf, _ := json.Marshal(c)
 	return string(jsonConf)
 }
 
+// Get the config as log fields, with secrets left out as for String
+func (c Config) LogFields() logrus.Fields {
+	fields := logrus.Fields{}
+	json.Unmarshal([]byte(c.String()), &fields)
+	return fields
+}
+
+func redactURLPassword(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	return u.String()
+}
+
+// Find the provider used by a rule, "default" means the default action
+func (c *Config) ruleProvider(name string) string {
+	if rule, ok := c.Rules[name]; ok && rule.Provider != "" {
+		return rule.Provider
+	}
+	return c.DefaultProvider
+}
+
 type Rule struct {
-	Action   string
-	Rule     string
-	Provider string
+	Action            string
+	Rule              string
+	Provider          string
+	PostLoginRedirect string
+	LogoutRedirect    string
+	MaxAge            int
+	Priority          int
 }
 
 func NewRule() *Rule {
 	return &Rule{
-		Action:   "auth",
-		Provider: "google", // TODO: Use default provider
+		Action: "auth",
 	}
 }
 
+// Get rule names in the order they are matched, highest priority first, then
+// by name so rules with equal priority are always matched in the same order
+func (c *Config) orderedRuleNames() []string {
+	// Sort the priorities with the names, rather than looking them up for
+	// every comparison, as there may be a large number of rules
+	type namedRule struct {
+		name     string
+		priority int
+	}
+	rules := make([]namedRule, 0, len(c.Rules))
+	for name, rule := range c.Rules {
+		rules = append(rules, namedRule{name, rule.Priority})
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].priority != rules[j].priority {
+			return rules[i].priority > rules[j].priority
+		}
+		return rules[i].name < rules[j].name
+	})
+
+	names := make([]string, len(rules))
+	for i, rule := range rules {
+		names[i] = rule.name
+	}
+	return names
+}
+
 func (r *Rule) formattedRule() string {
 	// Traefik implements their own "Host" matcher and then offers "HostRegexp"
 	// to invoke the mux "Host" matcher. This ensures the mux version is used
@@ -289,9 +838,18 @@ func (r *Rule) Validate() {
 		log.Fatal("invalid rule action, must be \"auth\" or \"allow\"")
 	}
 
-	// TODO: Update with more provider support
-	if r.Provider != "google" {
-		log.Fatal("invalid rule provider, must be \"google\"")
+	if r.PostLoginRedirect != "" {
+		u, err := url.Parse(r.PostLoginRedirect)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatal("invalid rule post-login-redirect, must be an absolute http or https URL")
+		}
+	}
+
+	if r.LogoutRedirect != "" {
+		u, err := url.Parse(r.LogoutRedirect)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatal("invalid rule logout-redirect, must be an absolute http or https URL")
+		}
 	}
 }
 
@@ -307,3 +865,38 @@ func (c *CommaSeparatedList) UnmarshalFlag(value string) error {
 func (c *CommaSeparatedList) MarshalFlag() (string, error) {
 	return strings.Join(*c, ","), nil
 }
+
+// IP network, accepts CIDR notation or a single IP address
+
+type IPNetwork struct {
+	net.IPNet
+}
+
+func (n *IPNetwork) UnmarshalFlag(value string) error {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address: %v", value)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		n.IPNet = net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return fmt.Errorf("invalid IP network: %v", value)
+	}
+
+	n.IPNet = *network
+	return nil
+}
+
+func (n *IPNetwork) MarshalFlag() (string, error) {
+	return n.String(), nil
+}
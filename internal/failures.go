@@ -0,0 +1,81 @@
+package tfa
+
+import (
+	"sync"
+	"time"
+)
+
+// Counts failed authentications by key (e.g. an email or client IP) within a
+// window starting at the first failure. This is held in memory, so counts
+// aren't shared between instances and are lost on restart
+type failureTracker struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	failures  map[string]*failureCount
+	lastSweep time.Time
+}
+
+type failureCount struct {
+	count   int
+	expires time.Time
+}
+
+func newFailureTracker(limit int, window time.Duration) *failureTracker {
+	return &failureTracker{
+		limit:    limit,
+		window:   window,
+		now:      time.Now,
+		failures: make(map[string]*failureCount),
+	}
+}
+
+// Check whether the key has reached the limit, along with how long until the
+// window ends
+func (t *failureTracker) blocked(key string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	f, ok := t.failures[key]
+	if !ok || !now.Before(f.expires) || f.count < t.limit {
+		return false, 0
+	}
+
+	return true, f.expires.Sub(now)
+}
+
+// Record a failure for each of the keys
+func (t *failureTracker) record(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.sweep(now)
+
+	for _, key := range keys {
+		f, ok := t.failures[key]
+		if !ok || !now.Before(f.expires) {
+			f = &failureCount{expires: now.Add(t.window)}
+			t.failures[key] = f
+		}
+		f.count++
+	}
+}
+
+// Remove expired counts, at most once per window so a burst of failures from
+// many keys doesn't make each record slower
+func (t *failureTracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.window {
+		return
+	}
+
+	for key, f := range t.failures {
+		if !now.Before(f.expires) {
+			delete(t.failures, key)
+		}
+	}
+	t.lastSweep = now
+}
@@ -0,0 +1,47 @@
+package tfa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestFailureTracker(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1000, 0)
+	tracker := newFailureTracker(2, time.Minute)
+	tracker.now = func() time.Time { return now }
+
+	// Should block once limit is reached
+	tracker.record("ip:1.1.1.1", "email:test@example.com")
+	blocked, _ := tracker.blocked("ip:1.1.1.1")
+	assert.False(blocked, "should not block below limit")
+
+	now = now.Add(10 * time.Second)
+	tracker.record("ip:1.1.1.1", "email:other@example.com")
+	blocked, retry := tracker.blocked("ip:1.1.1.1")
+	assert.True(blocked, "should block at limit")
+	assert.Equal(50*time.Second, retry, "should retry after window since first failure")
+
+	blocked, _ = tracker.blocked("email:test@example.com")
+	assert.False(blocked, "keys should be counted separately")
+
+	// Should reset after window
+	now = now.Add(50 * time.Second)
+	blocked, _ = tracker.blocked("ip:1.1.1.1")
+	assert.False(blocked, "should not block after window")
+
+	tracker.record("ip:1.1.1.1")
+	blocked, _ = tracker.blocked("ip:1.1.1.1")
+	assert.False(blocked, "count should restart after window")
+
+	// Should remove expired counts
+	now = now.Add(2 * time.Minute)
+	tracker.record("ip:2.2.2.2")
+	assert.Len(tracker.failures, 1)
+}
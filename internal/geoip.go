@@ -0,0 +1,75 @@
+package tfa
+
+import (
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Find the country of an IP, as an ISO 3166-1 alpha-2 code
+type countryLookup interface {
+	Country(ip net.IP) (string, error)
+}
+
+// GeoIP database in MaxMind format (e.g. GeoLite2 Country)
+type geoIPDatabase struct {
+	reader *maxminddb.Reader
+}
+
+func openGeoIPDatabase(path string) (*geoIPDatabase, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &geoIPDatabase{reader: reader}, nil
+}
+
+func (g *geoIPDatabase) Country(ip net.IP) (string, error) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+
+	err := g.reader.Lookup(ip, &record)
+	return record.Country.ISOCode, err
+}
+
+// Is the IP in a denied country, or not in an allowed country. When only
+// allowing countries, a missing IP or one that can't be located is denied
+func isDeniedCountry(ip net.IP) (string, bool) {
+	if config.GeoIP == nil {
+		return "", false
+	}
+
+	var country string
+	if ip != nil {
+		var err error
+		country, err = config.GeoIP.Country(ip)
+		if err != nil {
+			country = ""
+		}
+	}
+
+	if len(config.AllowCountries) > 0 {
+		return country, !containsCountry(config.AllowCountries, country)
+	}
+
+	return country, containsCountry(config.DenyCountries, country)
+}
+
+func containsCountry(countries []string, country string) bool {
+	if country == "" {
+		return false
+	}
+
+	for _, c := range countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+
+	return false
+}
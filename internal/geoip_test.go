@@ -0,0 +1,89 @@
+package tfa
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestGeoIPIsDeniedCountry(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	// Should allow everything without a database
+	_, denied := isDeniedCountry(net.ParseIP("1.1.1.1"))
+	assert.False(denied)
+
+	// Should deny listed countries
+	config.GeoIP = fakeCountryLookup{"1.1.1.1": "GB", "2.2.2.2": "FR"}
+	config.DenyCountries = CommaSeparatedList{"gb"}
+	country, denied := isDeniedCountry(net.ParseIP("1.1.1.1"))
+	assert.True(denied, "denied country should be denied")
+	assert.Equal("GB", country)
+	_, denied = isDeniedCountry(net.ParseIP("2.2.2.2"))
+	assert.False(denied, "other country should be allowed")
+	_, denied = isDeniedCountry(net.ParseIP("3.3.3.3"))
+	assert.False(denied, "unknown country should be allowed")
+	_, denied = isDeniedCountry(nil)
+	assert.False(denied, "missing IP should be allowed")
+
+	// Should only allow listed countries
+	config.DenyCountries = nil
+	config.AllowCountries = CommaSeparatedList{"GB"}
+	_, denied = isDeniedCountry(net.ParseIP("1.1.1.1"))
+	assert.False(denied, "allowed country should be allowed")
+	_, denied = isDeniedCountry(net.ParseIP("2.2.2.2"))
+	assert.True(denied, "other country should be denied")
+	_, denied = isDeniedCountry(net.ParseIP("3.3.3.3"))
+	assert.True(denied, "unknown country should be denied")
+	_, denied = isDeniedCountry(nil)
+	assert.True(denied, "missing IP should be denied")
+}
+
+func TestGeoIPOpenDatabase(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := openGeoIPDatabase("../test/missing.mmdb")
+	assert.Error(err)
+
+	_, err = NewConfig([]string{
+		"--geoip-db=../test/missing.mmdb",
+	})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "unable to open geoip-db")
+	}
+
+	_, err = NewConfig([]string{
+		"--deny-country=GB",
+	})
+	if assert.Error(err) {
+		assert.Equal("allow-country and deny-country require a geoip-db", err.Error())
+	}
+
+	_, err = NewConfig([]string{
+		"--deny-country=GB",
+		"--allow-country=FR",
+	})
+	if assert.Error(err) {
+		assert.Equal("allow-country and deny-country cannot be used together", err.Error())
+	}
+}
+
+/**
+ * Utilities
+ */
+
+type fakeCountryLookup map[string]string
+
+func (f fakeCountryLookup) Country(ip net.IP) (string, error) {
+	if country, ok := f[ip.String()]; ok {
+		return country, nil
+	}
+	return "", errors.New("not found")
+}
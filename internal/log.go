@@ -1,7 +1,11 @@
 package tfa
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"os"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
@@ -48,3 +52,29 @@ func NewDefaultLogger() logrus.FieldLogger {
 
 	return log
 }
+
+// Format an email for logging according to the log email mode. Hashed emails
+// are keyed with the secret, so the same user can be followed across log
+// lines without the address being guessable from the hash
+func logEmail(email string) string {
+	switch config.LogEmailMode {
+	case "hashed":
+		mac := hmac.New(sha256.New, config.Secret)
+		mac.Write([]byte(email))
+		return hex.EncodeToString(mac.Sum(nil))[:16]
+	case "masked":
+		return maskEmail(email)
+	// "full" is the default
+	default:
+		return email
+	}
+}
+
+// Mask all but the first character of the local part of an email
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
@@ -0,0 +1,38 @@
+package tfa
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestLogEmail(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should log full email by default
+	config, _ = NewConfig([]string{})
+	assert.Equal("test@example.com", logEmail("test@example.com"))
+
+	// Should mask email
+	config.LogEmailMode = "masked"
+	assert.Equal("t***@example.com", logEmail("test@example.com"))
+	assert.Equal("***", logEmail("invalid"))
+	assert.Equal("***", logEmail("@example.com"))
+
+	// Should hash email consistently
+	config.LogEmailMode = "hashed"
+	config.Secret = []byte("secret")
+	hashed := logEmail("test@example.com")
+	assert.Len(hashed, 16)
+	assert.NotContains(hashed, "example.com")
+	assert.Equal(hashed, logEmail("test@example.com"), "same email should have the same hash")
+	assert.NotEqual(hashed, logEmail("other@example.com"), "different emails should have different hashes")
+
+	// Should depend on the secret
+	config.Secret = []byte("another secret")
+	assert.NotEqual(hashed, logEmail("test@example.com"), "hash should be keyed with the secret")
+}
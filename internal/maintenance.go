@@ -0,0 +1,78 @@
+package tfa
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Maintenance mode can be changed while running, so is held by the server
+// rather than read from the config
+type maintenanceMode struct {
+	enabled int32
+}
+
+func (m *maintenanceMode) set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&m.enabled, v)
+}
+
+func (m *maintenanceMode) get() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+// Re-read the options on SIGHUP and apply the maintenance option, any other
+// changes need a restart
+func (s *Server) ReloadOnSignal(args []string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			s.reload(args)
+		}
+	}()
+}
+
+func (s *Server) reload(args []string) {
+	// Only parse the options, as building the config opens files
+	c := Config{Rules: map[string]*Rule{}}
+	if err := c.parseFlags(args); err != nil {
+		log.Errorf("Unable to reload options: %v", err)
+		return
+	}
+
+	s.maintenance.set(c.Maintenance)
+	log.WithFields(logrus.Fields{
+		"maintenance": c.Maintenance,
+	}).Info("Reloaded options")
+}
+
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+  <head><title>Sign in unavailable</title></head>
+  <body>
+    <p>Sign in is temporarily unavailable for maintenance, please try again later.</p>
+  </body>
+</html>
+`
+
+func maintenanceResponse(w http.ResponseWriter) {
+	page := []byte(defaultMaintenancePage)
+	if config.MaintenancePage != nil {
+		page = config.MaintenancePage
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(config.MaintenanceRetryAfter))
+	w.WriteHeader(503)
+	w.Write(page)
+}
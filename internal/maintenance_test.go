@@ -0,0 +1,41 @@
+package tfa
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestMaintenanceReload(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	s := NewServer()
+	assert.False(s.maintenance.get())
+
+	f, err := ioutil.TempFile("", "config")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	args := []string{"--config=" + f.Name()}
+
+	// Should apply maintenance from config file
+	ioutil.WriteFile(f.Name(), []byte("maintenance = true\n"), 0600)
+	s.reload(args)
+	assert.True(s.maintenance.get(), "maintenance should be enabled on reload")
+
+	ioutil.WriteFile(f.Name(), []byte("maintenance = false\n"), 0600)
+	s.reload(args)
+	assert.False(s.maintenance.get(), "maintenance should be disabled on reload")
+
+	// Should keep current mode on invalid options
+	s.maintenance.set(true)
+	ioutil.WriteFile(f.Name(), []byte("unknown-option = true\n"), 0600)
+	s.reload(args)
+	assert.True(s.maintenance.get(), "maintenance should be kept on invalid options")
+}
@@ -1,21 +1,111 @@
 package provider
 
 import (
+	"bytes"
+	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 )
 
+// Returned when a user is not from the configured hosted domain
+var ErrHostedDomain = errors.New("user is not from hosted domain")
+
+// Returned when the userinfo response is larger than allowed, e.g. for a user
+// in thousands of groups
+type UserinfoTooLargeError struct {
+	Size  int64
+	Limit int
+}
+
+func (e *UserinfoTooLargeError) Error() string {
+	return fmt.Sprintf("userinfo response of %d bytes is larger than the limit of %d bytes", e.Size, e.Limit)
+}
+
 type Google struct {
-	ClientId     string `long:"client-id" env:"CLIENT_ID" description:"Client ID"`
-	ClientSecret string `long:"client-secret" env:"CLIENT_SECRET" description:"Client Secret" json:"-"`
-	Scope        string
-	Prompt       string `long:"prompt" env:"PROMPT" description:"Space separated list of OpenID prompt options"`
+	ClientId               string `long:"client-id" env:"CLIENT_ID" description:"Client ID"`
+	ClientSecret           string `long:"client-secret" env:"CLIENT_SECRET" description:"Client Secret" json:"-"`
+	Scope                  string
+	Prompt                 string `long:"prompt" env:"PROMPT" description:"Space separated list of OpenID prompt options"`
+	HostedDomain           string `long:"hosted-domain" env:"HOSTED_DOMAIN" description:"Only allow users from the given Google Workspace domain"`
+	EmailClaim             string `long:"email-claim" env:"EMAIL_CLAIM" default:"email" description:"Userinfo claim containing the user's email"`
+	NameClaim              string `long:"name-claim" env:"NAME_CLAIM" default:"name" description:"Userinfo claim containing the user's name"`
+	MaxUserinfoBytes       int    `long:"max-userinfo-bytes" env:"MAX_USERINFO_BYTES" default:"262144" description:"Maximum size of the userinfo response in bytes, larger responses are rejected, 0 for no limit"`
+	HTTPProxy              string `long:"http-proxy" env:"HTTP_PROXY" description:"Proxy to use for requests to Google, overrides the environment"`
+	UserinfoMethod         string `long:"userinfo-method" env:"USERINFO_METHOD" default:"GET" choice:"GET" choice:"POST" description:"HTTP method used for userinfo requests"`
+	UserinfoTokenPlacement string `long:"userinfo-token-placement" env:"USERINFO_TOKEN_PLACEMENT" default:"header" choice:"header" choice:"query" choice:"body" description:"Where the access token is sent in userinfo requests, \"body\" requires the POST method"`
+	ResponseMode           string `long:"response-mode" env:"RESPONSE_MODE" default:"query" choice:"query" choice:"form_post" description:"How the provider returns the code to the callback, \"form_post\" requires the callback to be routed to this service directly"`
+	TokenAuthMethod        string `long:"token-auth-method" env:"TOKEN_AUTH_METHOD" default:"client_secret_post" choice:"client_secret_post" choice:"client_secret_basic" choice:"private_key_jwt" description:"How the client authenticates to the token endpoint, \"private_key_jwt\" requires client-assertion-key"`
+	ClientAssertionKey     string `long:"client-assertion-key" env:"CLIENT_ASSERTION_KEY" description:"Path to a PEM encoded RSA private key used to sign client assertions for private_key_jwt"`
+	ClientAssertionKeyID   string `long:"client-assertion-key-id" env:"CLIENT_ASSERTION_KEY_ID" description:"Key ID sent with client assertions, if the provider requires one"`
 
 	LoginURL *url.URL
 	TokenURL *url.URL
 	UserURL  *url.URL
+
+	// Transport used for all requests to Google, when nil a pooled transport
+	// with timeouts is created by Setup
+	Transport http.RoundTripper `json:"-"`
+
+	client       *http.Client
+	assertionKey *rsa.PrivateKey
+}
+
+// Timeout for each request to Google
+const requestTimeout = 30 * time.Second
+
+// Validate options and prepare the client used to talk to Google
+func (g *Google) Setup() error {
+	if g.UserinfoTokenPlacement == "body" && g.UserinfoMethod != "POST" {
+		return errors.New("providers.google.userinfo-token-placement body requires providers.google.userinfo-method POST")
+	}
+
+	if g.TokenAuthMethod == "private_key_jwt" {
+		if g.ClientAssertionKey == "" {
+			return errors.New("providers.google.token-auth-method private_key_jwt requires providers.google.client-assertion-key")
+		}
+
+		key, err := loadRSAPrivateKey(g.ClientAssertionKey)
+		if err != nil {
+			return fmt.Errorf("invalid providers.google.client-assertion-key: %v", err)
+		}
+		g.assertionKey = key
+	}
+
+	transport := g.Transport
+	if transport == nil {
+		proxy := http.ProxyFromEnvironment
+		if g.HTTPProxy != "" {
+			proxyURL, err := url.Parse(g.HTTPProxy)
+			if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+				return fmt.Errorf("invalid providers.google.http-proxy: %v", g.HTTPProxy)
+			}
+			proxy = http.ProxyURL(proxyURL)
+		}
+
+		transport = newTransport(proxy)
+	}
+
+	g.client = &http.Client{
+		Transport: transport,
+		Timeout:   requestTimeout,
+	}
+
+	return nil
+}
+
+// Get the http client, this is the default client if Setup wasn't called
+func (g *Google) httpClient() *http.Client {
+	if g.client == nil {
+		return http.DefaultClient
+	}
+	return g.client
 }
 
 func (g *Google) GetLoginURL(redirectUri, state string) string {
@@ -23,9 +113,15 @@ func (g *Google) GetLoginURL(redirectUri, state string) string {
 	q.Set("client_id", g.ClientId)
 	q.Set("response_type", "code")
 	q.Set("scope", g.Scope)
+	if g.ResponseMode == "form_post" {
+		q.Set("response_mode", "form_post")
+	}
 	if g.Prompt != "" {
 		q.Set("prompt", g.Prompt)
 	}
+	if g.HostedDomain != "" {
+		q.Set("hd", g.HostedDomain)
+	}
 	q.Set("redirect_uri", redirectUri)
 	q.Set("state", state)
 
@@ -38,19 +134,53 @@ func (g *Google) GetLoginURL(redirectUri, state string) string {
 
 func (g *Google) ExchangeCode(redirectUri, code string) (string, error) {
 	form := url.Values{}
-	form.Set("client_id", g.ClientId)
-	form.Set("client_secret", g.ClientSecret)
 	form.Set("grant_type", "authorization_code")
 	form.Set("redirect_uri", redirectUri)
 	form.Set("code", code)
 
-	res, err := http.PostForm(g.TokenURL.String(), form)
+	// Authenticate the client with the configured method
+	switch g.TokenAuthMethod {
+	case "client_secret_basic":
+		// Sent in the Authorization header below
+	case "private_key_jwt":
+		if g.assertionKey == nil {
+			return "", errors.New("client assertion key not loaded, Setup must be called")
+		}
+		assertion, err := signClientAssertion(g.assertionKey, g.ClientAssertionKeyID, g.ClientId, g.TokenURL.String())
+		if err != nil {
+			return "", err
+		}
+		form.Set("client_id", g.ClientId)
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", assertion)
+	default:
+		form.Set("client_id", g.ClientId)
+		form.Set("client_secret", g.ClientSecret)
+	}
+
+	req, err := http.NewRequest("POST", g.TokenURL.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if g.TokenAuthMethod == "client_secret_basic" {
+		// The credentials are form encoded before being used as the user
+		// and password, see RFC 6749 section 2.3.1
+		req.SetBasicAuth(url.QueryEscape(g.ClientId), url.QueryEscape(g.ClientSecret))
+	}
+
+	res, err := g.httpClient().Do(req)
 	if err != nil {
 		return "", err
 	}
 
-	var token Token
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		// e.g. invalid_grant for a code that has already been used
+		return "", fmt.Errorf("token request failed with status %d", res.StatusCode)
+	}
+
+	var token Token
 	err = json.NewDecoder(res.Body).Decode(&token)
 
 	return token.Token, err
@@ -59,20 +189,125 @@ func (g *Google) ExchangeCode(redirectUri, code string) (string, error) {
 func (g *Google) GetUser(token string) (User, error) {
 	var user User
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", g.UserURL.String(), nil)
+	req, err := g.userinfoRequest(token)
 	if err != nil {
 		return user, err
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-	res, err := client.Do(req)
+	res, err := g.httpClient().Do(req)
 	if err != nil {
 		return user, err
 	}
 
 	defer res.Body.Close()
-	err = json.NewDecoder(res.Body).Decode(&user)
+	if res.StatusCode != http.StatusOK {
+		return user, fmt.Errorf("userinfo request failed with status %d", res.StatusCode)
+	}
+
+	// Read at most one byte over the limit, so a large response is rejected
+	// without being held in memory
+	var reader io.Reader = res.Body
+	if g.MaxUserinfoBytes > 0 {
+		reader = io.LimitReader(res.Body, int64(g.MaxUserinfoBytes)+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return user, err
+	}
+	if g.MaxUserinfoBytes > 0 && len(body) > g.MaxUserinfoBytes {
+		// Count the rest of the response without keeping it, and find the
+		// email if it's within the limit so the user can be identified
+		rest, _ := io.Copy(ioutil.Discard, res.Body)
+		emailClaim := g.EmailClaim
+		if emailClaim == "" {
+			emailClaim = "email"
+		}
+		user.Email = partialClaim(body, emailClaim)
+		return user, &UserinfoTooLargeError{Size: int64(len(body)) + rest, Limit: g.MaxUserinfoBytes}
+	}
+
+	err = json.Unmarshal(body, &user)
+	if err != nil {
+		return user, err
+	}
+
+	var claims map[string]interface{}
+	err = json.Unmarshal(body, &claims)
+	if err != nil {
+		return user, err
+	}
+	user.mapClaims(claims, g.EmailClaim, g.NameClaim)
+
+	// The hd login param only restricts the account chooser, so must be
+	// verified here
+	if g.HostedDomain != "" && user.Hd != g.HostedDomain {
+		return user, ErrHostedDomain
+	}
+
+	return user, nil
+}
+
+// Find a top level string claim in a truncated userinfo response, empty if
+// the claim isn't found before the response was cut off
+func partialClaim(body []byte, name string) string {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return ""
+	}
+
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return ""
+		}
+
+		if key, ok := t.(string); ok && key == name {
+			var claim string
+			json.Unmarshal(value, &claim)
+			return claim
+		}
+	}
+
+	return ""
+}
+
+// Build the userinfo request, the access token is sent as a bearer token in
+// the Authorization header unless the provider needs it in the query or body
+// (RFC 6750)
+func (g *Google) userinfoRequest(token string) (*http.Request, error) {
+	method := g.UserinfoMethod
+	if method == "" {
+		method = "GET"
+	}
+
+	u := *g.UserURL
+	var body io.Reader
+	switch g.UserinfoTokenPlacement {
+	case "query":
+		q := u.Query()
+		q.Set("access_token", token)
+		u.RawQuery = q.Encode()
+	case "body":
+		body = strings.NewReader(url.Values{"access_token": {token}}.Encode())
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch g.UserinfoTokenPlacement {
+	case "query":
+	case "body":
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	default:
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
 
-	return user, err
+	return req, nil
 }
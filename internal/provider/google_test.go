@@ -0,0 +1,462 @@
+package provider
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestGoogleGetLoginURLHostedDomain(t *testing.T) {
+	assert := assert.New(t)
+	g := Google{
+		ClientId: "idtest",
+		Scope:    "scopetest",
+		LoginURL: &url.URL{
+			Scheme: "https",
+			Host:   "test.com",
+			Path:   "/auth",
+		},
+	}
+
+	// Should not set hd by default
+	uri, err := url.Parse(g.GetLoginURL("http://example.com/_oauth", "state"))
+	assert.Nil(err)
+	assert.Equal("", uri.Query().Get("hd"))
+
+	// Should set hd
+	g.HostedDomain = "example.com"
+	uri, err = url.Parse(g.GetLoginURL("http://example.com/_oauth", "state"))
+	assert.Nil(err)
+	assert.Equal("example.com", uri.Query().Get("hd"))
+}
+
+func TestGoogleGetLoginURLResponseMode(t *testing.T) {
+	assert := assert.New(t)
+	g := Google{
+		ClientId: "idtest",
+		Scope:    "scopetest",
+		LoginURL: &url.URL{
+			Scheme: "https",
+			Host:   "test.com",
+			Path:   "/auth",
+		},
+	}
+
+	// Should not set response_mode by default
+	uri, err := url.Parse(g.GetLoginURL("http://example.com/_oauth", "state"))
+	assert.Nil(err)
+	_, ok := uri.Query()["response_mode"]
+	assert.False(ok)
+
+	// Should request form_post
+	g.ResponseMode = "form_post"
+	uri, err = url.Parse(g.GetLoginURL("http://example.com/_oauth", "state"))
+	assert.Nil(err)
+	assert.Equal("form_post", uri.Query().Get("response_mode"))
+}
+
+func TestGoogleGetUserHostedDomain(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("Bearer 123456789", r.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"id":"1","email":"test@example.com","verified_email":true,"hd":"example.com"}`)
+	}))
+	defer server.Close()
+	userURL, _ := url.Parse(server.URL)
+	g := Google{UserURL: userURL}
+
+	// Should allow any domain by default
+	user, err := g.GetUser("123456789")
+	assert.Nil(err)
+	assert.Equal("test@example.com", user.Email)
+
+	// Should allow matching domain
+	g.HostedDomain = "example.com"
+	_, err = g.GetUser("123456789")
+	assert.Nil(err)
+
+	// Should reject other domain
+	g.HostedDomain = "test.com"
+	_, err = g.GetUser("123456789")
+	assert.Equal(ErrHostedDomain, err)
+}
+
+func TestGoogleGetUserTooLarge(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":"1","email":"test@example.com","groups":["`+strings.Repeat("a", 100)+`"]}`)
+	}))
+	defer server.Close()
+	userURL, _ := url.Parse(server.URL)
+	g := Google{UserURL: userURL}
+
+	// Should allow any size by default
+	_, err := g.GetUser("123456789")
+	assert.Nil(err)
+
+	// Should reject response over the limit, but still identify the user
+	g.MaxUserinfoBytes = 100
+	user, err := g.GetUser("123456789")
+	if assert.IsType(&UserinfoTooLargeError{}, err) {
+		assert.Equal("userinfo response of 151 bytes is larger than the limit of 100 bytes", err.Error())
+	}
+	assert.Equal("test@example.com", user.Email)
+
+	// Should not identify the user when the email is past the limit
+	g.MaxUserinfoBytes = 20
+	user, err = g.GetUser("123456789")
+	assert.IsType(&UserinfoTooLargeError{}, err)
+	assert.Equal("", user.Email)
+
+	// Should reject response one byte over the limit
+	g.MaxUserinfoBytes = 150
+	_, err = g.GetUser("123456789")
+	assert.IsType(&UserinfoTooLargeError{}, err)
+
+	// Should allow response within the limit
+	g.MaxUserinfoBytes = 151
+	_, err = g.GetUser("123456789")
+	assert.Nil(err)
+}
+
+func TestGoogleGetUserError(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		fmt.Fprint(w, `{"error":{"code":500,"message":"Backend Error"}}`)
+	}))
+	defer server.Close()
+	userURL, _ := url.Parse(server.URL)
+	g := Google{UserURL: userURL}
+
+	// Should return error for non 200 response
+	_, err := g.GetUser("123456789")
+	if assert.Error(err) {
+		assert.Equal("userinfo request failed with status 500", err.Error())
+	}
+}
+
+func TestGoogleGetUserClaims(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{
+			"id":"1",
+			"email":"test@example.com",
+			"name":"Test User",
+			"mail":"other@example.com",
+			"displayName":"Other User"
+		}`)
+	}))
+	defer server.Close()
+	userURL, _ := url.Parse(server.URL)
+
+	// Should use standard claims
+	g := Google{
+		UserURL:    userURL,
+		EmailClaim: "email",
+		NameClaim:  "name",
+	}
+	user, err := g.GetUser("123456789")
+	assert.Nil(err)
+	assert.Equal("1", user.Id)
+	assert.Equal("test@example.com", user.Email)
+	assert.Equal("Test User", user.Name)
+
+	// Should use mapped claims
+	g.EmailClaim = "mail"
+	g.NameClaim = "displayName"
+	user, err = g.GetUser("123456789")
+	assert.Nil(err)
+	assert.Equal("other@example.com", user.Email)
+	assert.Equal("Other User", user.Name)
+
+	// Should not fall back to other claims when mapped claim is missing
+	g.EmailClaim = "upn"
+	user, err = g.GetUser("123456789")
+	assert.Nil(err)
+	assert.Equal("", user.Email)
+}
+
+func TestGoogleGetUserTokenPlacement(t *testing.T) {
+	assert := assert.New(t)
+	var method, auth, query, form string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		auth = r.Header.Get("Authorization")
+		query = r.URL.Query().Get("access_token")
+		form = r.PostFormValue("access_token")
+		fmt.Fprint(w, `{"id":"1","email":"test@example.com"}`)
+	}))
+	defer server.Close()
+	userURL, _ := url.Parse(server.URL)
+
+	// Should send bearer token by default
+	g := Google{UserURL: userURL}
+	user, err := g.GetUser("123456789")
+	assert.Nil(err)
+	assert.Equal("test@example.com", user.Email)
+	assert.Equal("GET", method)
+	assert.Equal("Bearer 123456789", auth)
+	assert.Equal("", query)
+
+	// Should send token in query
+	g.UserinfoTokenPlacement = "query"
+	_, err = g.GetUser("123456789")
+	assert.Nil(err)
+	assert.Equal("GET", method)
+	assert.Equal("", auth)
+	assert.Equal("123456789", query)
+
+	// Should send token in POST body
+	g.UserinfoMethod = "POST"
+	g.UserinfoTokenPlacement = "body"
+	_, err = g.GetUser("123456789")
+	assert.Nil(err)
+	assert.Equal("POST", method)
+	assert.Equal("", auth)
+	assert.Equal("", query)
+	assert.Equal("123456789", form)
+}
+
+func TestGoogleSetupUserinfoRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should require POST when sending token in body
+	g := Google{UserinfoMethod: "GET", UserinfoTokenPlacement: "body"}
+	err := g.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.google.userinfo-token-placement body requires providers.google.userinfo-method POST", err.Error())
+	}
+
+	g.UserinfoMethod = "POST"
+	assert.Nil(g.Setup())
+}
+
+func TestGoogleSetupHTTPProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should reject invalid proxy
+	g := Google{HTTPProxy: "proxy.example.com"}
+	err := g.Setup()
+	if assert.Error(err) {
+		assert.Equal("invalid providers.google.http-proxy: proxy.example.com", err.Error())
+	}
+
+	// Should send requests via proxy
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		fmt.Fprint(w, `{"access_token":"123456789"}`)
+	}))
+	defer proxy.Close()
+
+	g = Google{
+		HTTPProxy: proxy.URL,
+		TokenURL: &url.URL{
+			Scheme: "http",
+			Host:   "token.example.com",
+			Path:   "/token",
+		},
+	}
+	err = g.Setup()
+	assert.Nil(err)
+
+	token, err := g.ExchangeCode("http://example.com/_oauth", "code")
+	assert.Nil(err)
+	assert.Equal("123456789", token)
+	assert.Equal("http://token.example.com/token", proxied, "request should be sent via proxy")
+}
+
+func TestGoogleExchangeCodeTokenAuthMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	var req *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		req = r
+		fmt.Fprint(w, `{"access_token":"123456789"}`)
+	}))
+	defer server.Close()
+	tokenURL, _ := url.Parse(server.URL + "/token")
+
+	// Should send secret in body by default
+	g := Google{ClientId: "id", ClientSecret: "secret", TokenURL: tokenURL}
+	_, err := g.ExchangeCode("http://example.com/_oauth", "code")
+	assert.Nil(err)
+	assert.Equal("id", req.PostForm.Get("client_id"))
+	assert.Equal("secret", req.PostForm.Get("client_secret"))
+	assert.Equal("code", req.PostForm.Get("code"))
+	assert.Equal("", req.Header.Get("Authorization"))
+
+	// Should send encoded secret with basic auth
+	g = Google{ClientId: "id", ClientSecret: "se:cret", TokenURL: tokenURL, TokenAuthMethod: "client_secret_basic"}
+	_, err = g.ExchangeCode("http://example.com/_oauth", "code")
+	assert.Nil(err)
+	user, pass, ok := req.BasicAuth()
+	assert.True(ok)
+	assert.Equal("id", user)
+	assert.Equal("se%3Acret", pass)
+	assert.Equal("", req.PostForm.Get("client_secret"), "secret should not be in body")
+	assert.Equal("code", req.PostForm.Get("code"))
+
+	// Should send signed client assertion
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	keyFile, err := ioutil.TempFile("", "key*.pem")
+	require.Nil(t, err)
+	defer os.Remove(keyFile.Name())
+	pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyFile.Close()
+
+	g = Google{
+		ClientId:             "id",
+		TokenURL:             tokenURL,
+		TokenAuthMethod:      "private_key_jwt",
+		ClientAssertionKey:   keyFile.Name(),
+		ClientAssertionKeyID: "key1",
+	}
+	require.Nil(t, g.Setup())
+	_, err = g.ExchangeCode("http://example.com/_oauth", "code")
+	assert.Nil(err)
+	assert.Equal("", req.Header.Get("Authorization"))
+	assert.Equal("", req.PostForm.Get("client_secret"))
+	assert.Equal("id", req.PostForm.Get("client_id"))
+	assert.Equal("urn:ietf:params:oauth:client-assertion-type:jwt-bearer", req.PostForm.Get("client_assertion_type"))
+
+	parts := strings.Split(req.PostForm.Get("client_assertion"), ".")
+	if assert.Len(parts, 3) {
+		var header map[string]string
+		decoded, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		json.Unmarshal(decoded, &header)
+		assert.Equal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "key1"}, header)
+
+		var claims map[string]interface{}
+		decoded, _ = base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(decoded, &claims)
+		assert.Equal("id", claims["iss"])
+		assert.Equal("id", claims["sub"])
+		assert.Equal(tokenURL.String(), claims["aud"])
+		assert.NotEmpty(claims["jti"])
+
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		assert.Nil(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature), "assertion should be signed with key")
+	}
+}
+
+func TestGoogleExchangeCodeError(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		fmt.Fprint(w, `{"error":"invalid_grant"}`)
+	}))
+	defer server.Close()
+	tokenURL, _ := url.Parse(server.URL)
+
+	g := Google{TokenURL: tokenURL}
+	_, err := g.ExchangeCode("http://example.com/_oauth", "code")
+	if assert.Error(err) {
+		assert.Equal("token request failed with status 400", err.Error())
+	}
+}
+
+func TestGoogleSetupTokenAuthMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should require key for private_key_jwt
+	g := Google{TokenAuthMethod: "private_key_jwt"}
+	err := g.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.google.token-auth-method private_key_jwt requires providers.google.client-assertion-key", err.Error())
+	}
+
+	g.ClientAssertionKey = "does-not-exist.pem"
+	err = g.Setup()
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "invalid providers.google.client-assertion-key")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestGoogleSetupTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should use pooled transport with timeout by default
+	g := Google{}
+	assert.Nil(g.Setup())
+	assert.Equal(requestTimeout, g.client.Timeout)
+	if transport, ok := g.client.Transport.(*http.Transport); assert.True(ok) {
+		assert.NotEqual(http.DefaultTransport, transport, "transport should not be shared")
+		assert.NotNil(transport.Proxy, "transport should use proxy from environment")
+		assert.Equal(10, transport.MaxIdleConnsPerHost)
+	}
+
+	// Should use given transport for all requests
+	var requested []string
+	g = Google{
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			requested = append(requested, r.URL.String())
+			body := `{"access_token":"123456789"}`
+			if r.URL.Path == "/userinfo" {
+				body = `{"email":"example@example.com"}`
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(strings.NewReader(body)),
+				Request:    r,
+			}, nil
+		}),
+		UserinfoMethod:         "GET",
+		UserinfoTokenPlacement: "header",
+		TokenURL: &url.URL{
+			Scheme: "https",
+			Host:   "token.example.com",
+			Path:   "/token",
+		},
+		UserURL: &url.URL{
+			Scheme: "https",
+			Host:   "user.example.com",
+			Path:   "/userinfo",
+		},
+	}
+	assert.Nil(g.Setup())
+
+	token, err := g.ExchangeCode("http://example.com/_oauth", "code")
+	assert.Nil(err)
+	assert.Equal("123456789", token)
+
+	user, err := g.GetUser(token)
+	assert.Nil(err)
+	assert.Equal("example@example.com", user.Email)
+	assert.Equal([]string{
+		"https://token.example.com/token",
+		"https://user.example.com/userinfo",
+	}, requested)
+}
@@ -1,9 +1,129 @@
 package provider
 
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
 type Providers struct {
 	Google Google `group:"Google Provider" namespace:"google" env-namespace:"GOOGLE"`
 }
 
+// Check a provider with the given name exists
+func (p *Providers) Exists(name string) bool {
+	return name == "google"
+}
+
+// Create a transport for requests to a provider. This has the same pooling
+// and timeouts as http.DefaultTransport, but isn't shared with anything else
+func newTransport(proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// Load a PEM encoded RSA private key, in either PKCS #1 or PKCS #8 form
+func loadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+// Lifetime of client assertions, these are used straight away so only need
+// to allow for clock differences
+const clientAssertionLifetime = 5 * time.Minute
+
+// Create a client assertion for the private_key_jwt token auth method, this
+// is a JWT signed with RS256 as described in RFC 7523
+func signClientAssertion(key *rsa.PrivateKey, keyID, clientID, audience string) (string, error) {
+	header := map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+	}
+	if keyID != "" {
+		header["kid"] = keyID
+	}
+
+	// The provider may reject a reused assertion, so each has a unique ID
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": audience,
+		"jti": hex.EncodeToString(jti),
+		"iat": now.Unix(),
+		"exp": now.Add(clientAssertionLifetime).Unix(),
+	}
+
+	var parts []string
+	for _, part := range []interface{}{header, claims} {
+		encoded, err := json.Marshal(part)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(encoded))
+	}
+
+	signed := strings.Join(parts, ".")
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
 type Token struct {
 	Token string `json:"access_token"`
 }
@@ -13,4 +133,16 @@ type User struct {
 	Email    string `json:"email"`
 	Verified bool   `json:"verified_email"`
 	Hd       string `json:"hd"`
+	Name     string `json:"name"`
+}
+
+// Set user fields from the given claims, empty claim names are ignored
+func (u *User) mapClaims(claims map[string]interface{}, emailClaim, nameClaim string) {
+	if emailClaim != "" {
+		u.Email, _ = claims[emailClaim].(string)
+	}
+
+	if nameClaim != "" {
+		u.Name, _ = claims[nameClaim].(string)
+	}
 }
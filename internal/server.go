@@ -1,19 +1,44 @@
 package tfa
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/containous/mux"
 	"github.com/containous/traefik/pkg/rules"
 	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
 )
 
+// Priority given to every rule's route, see buildRoutes
+const routePriority = 1
+
 type Server struct {
-	router *rules.Router
+	router          *rules.Router
+	logoutRedirects *rules.Router
+	inflight        chan struct{}
+	failures        *failureTracker
+	maintenance     maintenanceMode
 }
 
 func NewServer() *Server {
 	s := &Server{}
+	if config.MaxConcurrent > 0 {
+		s.inflight = make(chan struct{}, config.MaxConcurrent)
+	}
+	if config.AuthFailureLimit > 0 {
+		s.failures = newFailureTracker(config.AuthFailureLimit, config.AuthFailureWindow)
+	}
+	s.maintenance.set(config.Maintenance)
 	s.buildRoutes()
 	return s
 }
@@ -25,17 +50,43 @@ func (s *Server) buildRoutes() {
 		log.Fatal(err)
 	}
 
-	// Let's build a router
-	for name, rule := range config.Rules {
+	// Rules with a logout-redirect are also matched against logout requests
+	s.logoutRedirects, err = rules.NewRouter()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Add callback handler first, so rules matching a host don't capture our
+	// own paths, providers using form_post return with a POST
+	callbackMethods := []string{"GET"}
+	if config.Providers.Google.ResponseMode == "form_post" {
+		callbackMethods = append(callbackMethods, "POST")
+	}
+	s.router.Handle(config.Path, s.methodGuard(s.AuthCallbackHandler(), callbackMethods...))
+
+	// Add logout handler
+	logoutMethods := []string{"GET"}
+	if config.LogoutRequirePost {
+		logoutMethods = append(logoutMethods, "POST")
+	}
+	s.router.Handle(config.Path+"/logout", s.methodGuard(s.LogoutHandler(), logoutMethods...))
+
+	// Add rules, the router is never sorted so the first matching route
+	// handles the request and rules are added in priority order. The same
+	// priority is given to every route, as the router would otherwise use the
+	// length of a rule in place of 0
+	for _, name := range config.orderedRuleNames() {
+		rule := config.Rules[name]
 		if rule.Action == "allow" {
-			s.router.AddRoute(rule.formattedRule(), 1, s.AllowHandler(name))
+			s.router.AddRoute(rule.formattedRule(), routePriority, s.AllowHandler(name))
 		} else {
-			s.router.AddRoute(rule.formattedRule(), 1, s.AuthHandler(name))
+			s.router.AddRoute(rule.formattedRule(), routePriority, s.AuthHandler(name))
 		}
-	}
 
-	// Add callback handler
-	s.router.Handle(config.Path, s.AuthCallbackHandler())
+		if rule.LogoutRedirect != "" {
+			s.logoutRedirects.AddRoute(rule.formattedRule(), routePriority, logoutRedirect(rule.LogoutRedirect))
+		}
+	}
 
 	// Add a default handler
 	if config.DefaultAction == "allow" {
@@ -46,20 +97,234 @@ func (s *Server) buildRoutes() {
 }
 
 func (s *Server) RootHandler(w http.ResponseWriter, r *http.Request) {
-	// Modify request
-	r.Method = r.Header.Get("X-Forwarded-Method")
+	// Deny blocked clients before doing anything else
+	if ip := clientIP(r); isBlockedIP(ip) {
+		log.WithFields(logrus.Fields{
+			"source_ip": ip.String(),
+		}).Warn("Denying request from blocked IP")
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	if country, denied := isDeniedCountry(clientIP(r)); denied {
+		log.WithFields(logrus.Fields{
+			"source_ip": sourceIP(r),
+			"country":   country,
+		}).Warn("Denying request from denied country")
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+
+	// Reject oversized headers, usually caused by a large cookie
+	if size, largest := headerSize(r.Header); size > config.MaxHeaderBytes {
+		log.WithFields(logrus.Fields{
+			"source_ip":        sourceIP(r),
+			"header_bytes":     size,
+			"max_header_bytes": config.MaxHeaderBytes,
+			"largest_header":   largest,
+		}).Warn("Rejecting request, headers too large")
+		http.Error(w, "Request header fields too large", 431)
+		return
+	}
+
+	// Shed load when at the concurrency limit
+	if s.inflight != nil {
+		select {
+		case s.inflight <- struct{}{}:
+			defer func() { <-s.inflight }()
+		default:
+			log.WithFields(logrus.Fields{
+				"source_ip":      sourceIP(r),
+				"max_concurrent": config.MaxConcurrent,
+			}).Warn("Shedding request, too many concurrent requests")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+	}
+
+	// Answer favicon requests to the auth host before rules, browsers request
+	// these during login and they would otherwise be redirected to login
+	if config.FaviconData != nil && isFaviconRequest(r) {
+		faviconResponse(w, r)
+		return
+	}
+
+	// Requests made directly have none of the headers traefik sets
+	if config.DirectAccess != "auth" && isDirectAccess(r) {
+		log.WithFields(logrus.Fields{
+			"source_ip": sourceIP(r),
+			"path":      r.URL.Path,
+		}).Info("Handling direct access")
+		directAccessResponse(w, r)
+		return
+	}
+
+	// Modify request, the host is normalised first as it's also read from the
+	// header when matching cookie domains
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		r.Header.Set("X-Forwarded-Host", normalizeHost(host))
+	}
+	if method := r.Header.Get("X-Forwarded-Method"); method != "" {
+		r.Method = method
+	}
 	r.Host = r.Header.Get("X-Forwarded-Host")
-	r.URL, _ = url.Parse(r.Header.Get("X-Forwarded-Uri"))
+	u, err := forwardedURL(r)
+	if isDirectCallback(r) {
+		u, err = r.URL, nil
+	}
+	if err == nil && r.Host == "" {
+		err = errors.New("Missing X-Forwarded-Host")
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"source_ip": sourceIP(r),
+			"host":      r.Host,
+			"uri":       r.Header.Get("X-Forwarded-Uri"),
+		}).Warn(err)
+		if config.RequireForwardedHeaders {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+	}
+	r.URL = u
+
+	// The method is used for routing, so must at least be well formed
+	if !validMethod(r.Method) {
+		log.WithFields(logrus.Fields{
+			"source_ip": sourceIP(r),
+			"method":    r.Method,
+		}).Warn("Invalid X-Forwarded-Method")
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	// Allow CORS preflight, this passes it on to the upstream which must
+	// respond with the CORS headers
+	if config.CORSPreflight && ValidateCORSPreflight(r) {
+		log.WithFields(logrus.Fields{
+			"source_ip": sourceIP(r),
+			"origin":    r.Header.Get("Origin"),
+		}).Debug("Allowing CORS preflight request")
+		w.WriteHeader(204)
+		return
+	}
 
 	// Pass to mux
 	s.router.ServeHTTP(w, r)
 }
 
+// Lowercase a host and remove any trailing dot, e.g. "App.example.com.:443"
+// becomes "app.example.com:443"
+func normalizeHost(host string) string {
+	host = strings.ToLower(host)
+	if name, port, err := net.SplitHostPort(host); err == nil {
+		return net.JoinHostPort(strings.TrimSuffix(name, "."), port)
+	}
+
+	return strings.TrimSuffix(host, ".")
+}
+
+// Find the size of the headers as sent, along with the name of the largest
+// header to help find the cause of oversized requests
+func headerSize(h http.Header) (int, string) {
+	var size, largestSize int
+	var largest string
+	for name, values := range h {
+		var total int
+		for _, value := range values {
+			// "Name: value\r\n"
+			total += len(name) + len(value) + 4
+		}
+
+		size += total
+		if total > largestSize {
+			largestSize = total
+			largest = name
+		}
+	}
+
+	return size, largest
+}
+
+// Check a method is a valid token (RFC 7230), extension methods such as
+// those used by WebDAV are allowed
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+
+	for _, c := range method {
+		if c > unicode.MaxASCII || !(unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Get the URL from X-Forwarded-Uri, if it's missing or invalid "/" is
+// returned along with an error
+func forwardedURL(r *http.Request) (*url.URL, error) {
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		return &url.URL{Path: "/"}, errors.New("Missing X-Forwarded-Uri")
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return &url.URL{Path: "/"}, fmt.Errorf("Invalid X-Forwarded-Uri: %v", err)
+	}
+
+	return u, nil
+}
+
+// A form_post callback must be routed to this service directly, as traefik
+// doesn't forward the body to forward auth. These requests have no
+// X-Forwarded-Uri, but are made to the callback path itself
+func isDirectCallback(r *http.Request) bool {
+	return r.Header.Get("X-Forwarded-Uri") == "" && r.URL.Path == config.Path
+}
+
+// Restrict handler to the given methods, as in net/http an empty method is
+// treated as GET
+func (s *Server) methodGuard(handler http.Handler, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		method := r.Method
+		if method == "" {
+			method = "GET"
+		}
+
+		for _, m := range methods {
+			if method == m {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		log.WithFields(logrus.Fields{
+			"method": method,
+			"path":   r.URL.Path,
+		}).Warn("Method not allowed")
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
 // Handler that allows requests
 func (s *Server) AllowHandler(rule string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		s.logger(r, rule, "Allowing request")
-		w.WriteHeader(200)
+		logger := s.logger(r, rule, "Allowing request")
+
+		// Identify users that have a session, without requiring one
+		if config.AllowForwardUser {
+			if email, ok := sessionUser(r); ok {
+				logger.WithFields(logrus.Fields{
+					"user": logEmail(email),
+				}).Debug("Forwarding user of allowed request")
+				w.Header().Set("X-Forwarded-User", email)
+			}
+		}
+
+		writeAllowed(w, r)
 	}
 }
 
@@ -69,19 +334,65 @@ func (s *Server) AuthHandler(rule string) http.HandlerFunc {
 		// Logging setup
 		logger := s.logger(r, rule, "Authenticating request")
 
+		// Never authenticate over plaintext as the auth cookie would be exposed
+		if config.RequireHTTPS && r.Header.Get("X-Forwarded-Proto") != "https" {
+			// The host and URL have already been normalised and checked
+			if (r.Method == "GET" || r.Method == "HEAD") && r.Host != "" {
+				logger.Info("Redirecting plaintext request to https")
+				http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			} else {
+				logger.Warn("Denying plaintext request")
+				http.Error(w, "Forbidden", 403)
+			}
+			return
+		}
+
+		// Accept user from a trusted proxy
+		if user := r.Header.Get("X-Forwarded-User"); config.TrustForwardedUserHeader && user != "" {
+			logger := logger.WithFields(logrus.Fields{
+				"user":    logEmail(user),
+				"peer_ip": forwardedPeerIP(r),
+			})
+
+			if isTrustedProxy(r) {
+				if !ValidateEmail(user) {
+					logger.Error("Invalid email in X-Forwarded-User from trusted proxy")
+					http.Error(w, "Not authorized", 401)
+					return
+				}
+
+				logger.Info("Allowing request with X-Forwarded-User from trusted proxy")
+				w.Header().Set("X-Forwarded-User", user)
+				writeAllowed(w, r)
+				return
+			}
+
+			logger.Warn("Ignoring X-Forwarded-User from untrusted source")
+		}
+
+		// Allow specific agents that can't authenticate, e.g. health checks
+		if agent := r.Header.Get("User-Agent"); isSkipAuthUserAgent(agent) {
+			logger.WithFields(logrus.Fields{
+				"user_agent": agent,
+			}).Info("Allowing request from skipped User-Agent")
+			writeAllowed(w, r)
+			return
+		}
+
 		// Get auth cookie
 		c, err := r.Cookie(config.CookieName)
 		if err != nil {
-			s.authRedirect(logger, w, r)
+			s.authRedirect(logger, w, r, rule)
 			return
 		}
 
 		// Validate cookie
 		email, err := ValidateCookie(r, c)
 		if err != nil {
-			if err.Error() == "Cookie has expired" {
-				logger.Info("Cookie has expired")
-				s.authRedirect(logger, w, r)
+			if err.Error() == "Cookie has expired" || err.Error() == "Cookie has been idle for too long" ||
+				err.Error() == "Invalid cookie mac or bound to a different client" {
+				logger.Info(err.Error())
+				s.authRedirect(logger, w, r, rule)
 			} else {
 				logger.Errorf("Invalid cookie: %v", err)
 				http.Error(w, "Not authorized", 401)
@@ -93,17 +404,166 @@ func (s *Server) AuthHandler(rule string) http.HandlerFunc {
 		valid := ValidateEmail(email)
 		if !valid {
 			logger.WithFields(logrus.Fields{
-				"email": email,
+				"email": logEmail(email),
 			}).Errorf("Invalid email")
 			http.Error(w, "Not authorized", 401)
 			return
 		}
 
+		// Require a new login if the session is older than requested
+		if maxAge, ok := loginMaxAge(r, rule); ok && cookieAge(c) > maxAge+maxAgeLeeway {
+			logger.WithFields(logrus.Fields{
+				"email":   logEmail(email),
+				"max_age": maxAge.Seconds(),
+			}).Info("Session is older than requested max age")
+			s.authRedirect(logger, w, r, rule)
+			return
+		}
+
+		// Record activity, traefik only passes headers of an allowed response
+		// to the upstream, so the refreshed cookie is set by redirecting back
+		// to the same URL. Only GET and HEAD requests without an upgrade can be
+		// repeated like this, activity is recorded by a later one otherwise
+		if canRefreshCookie(r) {
+			if refreshed := RefreshCookie(r, c); refreshed != nil {
+				logger.Debug("Refreshing cookie activity")
+				SetCookie(w, refreshed)
+				http.Redirect(w, r, returnUrl(r), http.StatusTemporaryRedirect)
+				return
+			}
+		}
+
 		// Valid request
 		logger.Debugf("Allowing valid request ")
 		w.Header().Set("X-Forwarded-User", email)
-		w.WriteHeader(200)
+		if config.AuthExpiresHeader {
+			w.Header().Set("X-Auth-Expires", strconv.FormatInt(cookieExpires(c).Unix(), 10))
+		}
+		writeAllowed(w, r)
+	}
+}
+
+func canRefreshCookie(r *http.Request) bool {
+	return (r.Method == "GET" || r.Method == "HEAD") && r.Header.Get("Upgrade") == ""
+}
+
+func isSkipAuthUserAgent(agent string) bool {
+	for _, matcher := range config.SkipAuthUserAgentMatchers {
+		if matcher.MatchString(agent) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A blank 1x1 icon, used by default to answer favicon requests
+var defaultFavicon = []byte{
+	0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00,
+	0x20, 0x00, 0x44, 0x00, 0x00, 0x00, 0x16, 0x00, 0x00, 0x00, 0x89, 0x50,
+	0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48,
+	0x44, 0x52, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x08, 0x06,
+	0x00, 0x00, 0x00, 0x1f, 0x15, 0xc4, 0x89, 0x00, 0x00, 0x00, 0x0b, 0x49,
+	0x44, 0x41, 0x54, 0x78, 0x9c, 0x63, 0x60, 0x00, 0x02, 0x00, 0x00, 0x05,
+	0x00, 0x01, 0x7a, 0x5e, 0xab, 0x3f, 0x00, 0x00, 0x00, 0x00, 0x49, 0x45,
+	0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
+}
+
+func isFaviconRequest(r *http.Request) bool {
+	if r.Header.Get("X-Forwarded-Uri") == "" {
+		return r.URL.Path == "/favicon.ico"
+	}
+
+	// Only the auth host's icon is ours, other hosts' icons are served by
+	// their apps so are protected like any other path
+	host := removePort(normalizeHost(r.Header.Get("X-Forwarded-Host")))
+	if config.AuthHost == "" || host != removePort(normalizeHost(config.AuthHost)) {
+		return false
 	}
+
+	u, err := forwardedURL(r)
+	return err == nil && u.Path == "/favicon.ico"
+}
+
+func faviconResponse(w http.ResponseWriter, r *http.Request) {
+	// Traefik discards the body of forward auth responses, so allow the
+	// request on to the upstream, which is this service on the auth host
+	if r.Header.Get("X-Forwarded-Uri") != "" {
+		w.WriteHeader(204)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(config.FaviconData))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(config.FaviconData)
+}
+
+func isDirectAccess(r *http.Request) bool {
+	return r.Header.Get("X-Forwarded-Host") == "" && r.Header.Get("X-Forwarded-Uri") == ""
+}
+
+const directAccessPage = `<!DOCTYPE html>
+<html>
+  <head><title>traefik-forward-auth</title></head>
+  <body>
+    <p>This service authenticates requests for traefik's forward auth middleware and can't be used directly.</p>
+  </body>
+</html>
+`
+
+func directAccessResponse(w http.ResponseWriter, r *http.Request) {
+	if config.DirectAccess == "not-found" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Must not be a 2xx, in case traefik is misconfigured to send requests
+	// without the forwarded headers
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(401)
+	fmt.Fprint(w, directAccessPage)
+}
+
+func isWebsocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// Headers that may be set on a response allowing a request
+var allowedResponseHeaders = []string{"X-Forwarded-User", "X-Auth-Expires", "Set-Cookie"}
+
+// Allow the request, any header not explicitly allowed is removed first so
+// only the intended headers can be passed on by traefik. Request headers set
+// to be copied are then added
+func writeAllowed(w http.ResponseWriter, r *http.Request) {
+	for name := range w.Header() {
+		if !isAllowedResponseHeader(name) {
+			w.Header().Del(name)
+		}
+	}
+
+	for _, name := range config.CopyRequestHeaders {
+		if values := r.Header[http.CanonicalHeaderKey(name)]; len(values) > 0 {
+			w.Header()[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	w.WriteHeader(200)
+}
+
+func isAllowedResponseHeader(name string) bool {
+	for _, allowed := range allowedResponseHeaders {
+		if http.CanonicalHeaderKey(allowed) == name {
+			return true
+		}
+	}
+
+	for _, allowed := range config.AuthResponseHeaders {
+		if http.CanonicalHeaderKey(allowed) == name {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Handle auth callback
@@ -112,16 +572,51 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 		// Logging setup
 		logger := s.logger(r, "default", "Handling callback")
 
+		// The provider may be unavailable, so don't try to exchange the code
+		if s.maintenance.get() {
+			logger.Info("Showing maintenance page for callback")
+			maintenanceResponse(w)
+			return
+		}
+
+		// Slow down clients with too many failed logins
+		if s.failureBlocked(logger, w, ipFailureKey(r)) {
+			return
+		}
+
+		// Check where the callback came from, this is done before the CSRF
+		// cookie is used so a forged callback doesn't spoil a real login
+		if config.CheckCallbackOrigin {
+			if origin := callbackOrigin(r); origin == "" {
+				logger.Debug("Callback has no Origin or Referer, only checking csrf cookie")
+			} else if !ValidateCallbackOrigin(r, origin) {
+				logger.WithFields(logrus.Fields{
+					"origin": origin,
+				}).Warn("Invalid callback origin")
+				http.Error(w, "Forbidden", 403)
+				return
+			}
+		}
+
 		// Check for CSRF cookie
 		c, err := r.Cookie(config.CSRFCookieName)
 		if err != nil {
-			logger.Warn("Missing csrf cookie")
+			// The callback may have been repeated after the login completed
+			if s.reuseSession(logger, w, r, stateRedirect(callbackParams(r).Get("state"))) {
+				return
+			}
+
+			// Browsers drop cookies not allowed by their SameSite attribute,
+			// which causes a login loop
+			logger.WithFields(logrus.Fields{
+				"csrf_samesite": config.CSRFSameSite,
+			}).Warn("Missing csrf cookie, if this repeats the browser may be dropping it, see csrf-samesite")
 			http.Error(w, "Not authorized", 401)
 			return
 		}
 
 		// Validate state
-		valid, redirect, err := ValidateCSRFCookie(r, c)
+		valid, state, err := ValidateCSRFCookie(r, c)
 		if !valid {
 			logger.Warnf("Error validating csrf cookie: %v", err)
 			http.Error(w, "Not authorized", 401)
@@ -129,35 +624,298 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 		}
 
 		// Clear CSRF cookie
-		http.SetCookie(w, ClearCSRFCookie(r))
+		SetCSRFCookie(w, ClearCSRFCookie(r))
+
+		// Check the redirect, the state is round tripped through the client
+		redirect, remember := splitState(state)
+		redirect, _, _ = splitStateMaxAge(redirect)
+		if !ValidateRedirect(r, redirect) {
+			logger.WithFields(logrus.Fields{
+				"redirect": redirect,
+			}).Warn("Invalid redirect in state")
+			http.Error(w, "Bad request", 400)
+			return
+		}
+
+		// Check for an error from the provider
+		if providerErr := callbackParams(r).Get("error"); providerErr != "" {
+			logger.WithFields(logrus.Fields{
+				"error":             providerErr,
+				"error_description": callbackParams(r).Get("error_description"),
+			}).Warn("Provider returned an error")
+			code, msg := providerErrorResponse(providerErr)
+			http.Error(w, msg, code)
+			return
+		}
 
 		// Exchange code for token
 		token, err := ExchangeCode(r)
 		if err != nil {
 			logger.Errorf("Code exchange failed with: %v", err)
+			if s.reuseSession(logger, w, r, redirect) {
+				return
+			}
 			http.Error(w, "Service unavailable", 503)
 			return
 		}
 
 		// Get user
 		user, err := GetUser(token)
+		if user.Email != "" {
+			logger := logger.WithFields(logrus.Fields{
+				"user": logEmail(user.Email),
+			})
+			if s.failureBlocked(logger, w, emailFailureKey(user.Email)) {
+				return
+			}
+		}
+		if err == provider.ErrHostedDomain {
+			logger.WithFields(logrus.Fields{
+				"user":   logEmail(user.Email),
+				"domain": user.Hd,
+			}).Warn("User is not from hosted domain")
+			s.recordFailure(r, user.Email)
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		if tooLarge, ok := err.(*provider.UserinfoTooLargeError); ok {
+			logger.WithFields(logrus.Fields{
+				"user":  logEmail(user.Email),
+				"size":  tooLarge.Size,
+				"limit": tooLarge.Limit,
+			}).Warn("Userinfo response is too large")
+			http.Error(w, "Forbidden", 403)
+			return
+		}
 		if err != nil {
 			logger.Errorf("Error getting user: %s", err)
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		// Cookies are keyed on the email, so we can't continue without one
+		if user.Email == "" {
+			logger.WithFields(logrus.Fields{
+				"user_id": user.Id,
+			}).Error("Provider did not return an email for user")
+			http.Error(w, "Forbidden", 403)
 			return
 		}
 
+		// Users that aren't allowed are denied by AuthHandler, but this is
+		// where they logged in so count the failure here
+		if !ValidateEmail(user.Email) {
+			s.recordFailure(r, user.Email)
+		}
+
 		// Generate cookie
-		http.SetCookie(w, MakeCookie(r, user.Email))
+		if remember {
+			SetCookie(w, MakeCookie(r, user.Email))
+		} else {
+			SetCookie(w, MakeSessionCookie(r, user.Email))
+		}
 		logger.WithFields(logrus.Fields{
-			"user": user.Email,
+			"user":     logEmail(user.Email),
+			"remember": remember,
 		}).Infof("Generated auth cookie")
 
+		// Count logins, a valid auth cookie from an earlier login shows the
+		// cookie is being kept so counting starts again. Traefik drops cookies
+		// set on an allowed response, so this can't be done there
+		if config.MaxLoginAttempts > 0 {
+			attempts := loginAttempts(r) + 1
+			if _, ok := sessionUser(r); ok {
+				attempts = 1
+			}
+			SetCSRFCookie(w, MakeLoginAttemptsCookie(r, attempts))
+		}
+
 		// Redirect
 		http.Redirect(w, r, redirect, http.StatusTemporaryRedirect)
 	}
 }
 
-func (s *Server) authRedirect(logger *logrus.Entry, w http.ResponseWriter, r *http.Request) {
+// Get the failure key of the client, empty if the client IP isn't known as
+// every such client would otherwise share a key
+func ipFailureKey(r *http.Request) string {
+	ip := sourceIP(r)
+	if ip == "" {
+		return ""
+	}
+
+	return "ip:" + ip
+}
+
+func emailFailureKey(email string) string {
+	return "email:" + strings.ToLower(normalizeEmail(email))
+}
+
+// Count a failed authentication against both the client and the user
+func (s *Server) recordFailure(r *http.Request, email string) {
+	if s.failures == nil {
+		return
+	}
+
+	if key := ipFailureKey(r); key != "" {
+		s.failures.record(key, emailFailureKey(email))
+	} else {
+		s.failures.record(emailFailureKey(email))
+	}
+}
+
+// Respond with a 429 when the key has too many failed authentications
+func (s *Server) failureBlocked(logger *logrus.Entry, w http.ResponseWriter, key string) bool {
+	if s.failures == nil || key == "" {
+		return false
+	}
+
+	blocked, retry := s.failures.blocked(key)
+	if !blocked {
+		return false
+	}
+
+	logger.WithFields(logrus.Fields{
+		"auth_failure_limit": config.AuthFailureLimit,
+	}).Warn("Too many failed authentications")
+	w.Header().Set("Retry-After", strconv.Itoa(int((retry+time.Second-1)/time.Second)))
+	http.Error(w, "Too many requests", 429)
+	return true
+}
+
+// Handle logout
+func (s *Server) LogoutHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Logging setup
+		logger := s.logger(r, "default", "Handling logout")
+
+		// Require confirmation, so a plain GET (e.g. an <img> tag on another
+		// site) can't log users out
+		if config.LogoutRequirePost && r.Method != "POST" {
+			logger.Debug("Rendering logout confirmation page")
+			s.logoutConfirmPage(logger, w, r)
+			return
+		}
+
+		// The confirmation form carries a token tied to the auth cookie, so
+		// another site can't submit it either
+		if config.LogoutRequirePost && !validLogoutToken(r) {
+			logger.Warn("Invalid logout token")
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+
+		// Replace any cookies already set with a clearing cookie for the auth
+		// cookie on every domain it may have been set on, and for any login
+		// in progress
+		w.Header().Del("Set-Cookie")
+		for _, c := range ClearCookies(r) {
+			SetCookie(w, c)
+		}
+		SetCSRFCookie(w, ClearCSRFCookie(r))
+		SetCSRFCookie(w, ClearLoginAttemptsCookie(r))
+
+		logger.Info("Logged out user")
+
+		// Send the user on if a rule matching the request has a logout-redirect
+		// Send the user on if a rule matching the request has a logout-redirect
+		if redirect := s.logoutRedirect(r); redirect != "" {
+			if ValidateRedirect(r, redirect) {
+				// See other, so a POST logout is followed with a GET
+				http.Redirect(w, r, redirect, http.StatusSeeOther)
+				return
+			}
+
+			logger.WithFields(logrus.Fields{
+				"redirect": redirect,
+			}).Warn("Invalid logout-redirect")
+		}
+
+		http.Error(w, "You have been logged out", 401)
+	}
+}
+
+// Get the user of a valid auth cookie, if the request has one
+func sessionUser(r *http.Request) (string, bool) {
+	c, err := r.Cookie(config.CookieName)
+	if err != nil {
+		return "", false
+	}
+
+	email, err := ValidateCookie(r, c)
+	if err != nil || !ValidateEmail(email) {
+		return "", false
+	}
+
+	return email, true
+}
+
+// Redirect a failed callback with the user's existing session when enabled,
+// the callback may have been repeated after the login completed. Returns
+// false if there is no valid session to reuse
+func (s *Server) reuseSession(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, redirect string) bool {
+	if !config.CallbackReuseSession || !ValidateRedirect(r, redirect) {
+		return false
+	}
+
+	email, ok := sessionUser(r)
+	if !ok {
+		return false
+	}
+
+	logger.WithFields(logrus.Fields{
+		"user":     logEmail(email),
+		"redirect": redirect,
+	}).Info("Callback failed, reusing existing session")
+	http.Redirect(w, r, redirect, http.StatusTemporaryRedirect)
+	return true
+}
+
+// Handler of a logout-redirect route, this is only used to find the redirect
+// of the rule matching a logout request so is never served
+type logoutRedirect string
+
+func (l logoutRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {}
+
+// Get the logout-redirect of the first rule matching the request, if any
+func (s *Server) logoutRedirect(r *http.Request) string {
+	var match mux.RouteMatch
+	if s.logoutRedirects.Match(r, &match) {
+		if redirect, ok := match.Handler.(logoutRedirect); ok {
+			return string(redirect)
+		}
+	}
+
+	return ""
+}
+
+// Map an OAuth error code to a response, distinguishing users that chose not
+// to sign in from errors with the provider
+func providerErrorResponse(providerErr string) (int, string) {
+	switch providerErr {
+	case "access_denied":
+		return 403, "You cancelled sign in"
+	case "server_error", "temporarily_unavailable":
+		return 503, "Service unavailable"
+	default:
+		return 401, "Not authorized"
+	}
+}
+
+func (s *Server) authRedirect(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, rule string) {
+	// WebSocket clients can't follow a redirect, so fail cleanly instead
+	if config.WebsocketNoRedirect && isWebsocketUpgrade(r) {
+		logger.Info("Denying unauthenticated WebSocket upgrade")
+		http.Error(w, "Not authorized", 401)
+		return
+	}
+
+	// Don't send users to the provider during maintenance
+	if s.maintenance.get() {
+		logger.Info("Showing maintenance page rather than redirecting to login")
+		maintenanceResponse(w)
+		return
+	}
+
 	// Error indicates no cookie, generate nonce
 	err, nonce := Nonce()
 	if err != nil {
@@ -166,28 +924,201 @@ func (s *Server) authRedirect(logger *logrus.Entry, w http.ResponseWriter, r *ht
 		return
 	}
 
+	// Stop redirecting if the user keeps logging in without the auth cookie
+	// being kept, as another login won't help. A valid auth cookie, e.g. one
+	// older than a rule's max age, shows it is being kept
+	attempts := loginAttempts(r)
+	if attempts > 0 && config.MaxLoginAttempts > 0 {
+		if _, ok := sessionUser(r); ok {
+			SetCSRFCookie(w, ClearLoginAttemptsCookie(r))
+			attempts = 0
+		}
+	}
+	if config.MaxLoginAttempts > 0 && attempts >= config.MaxLoginAttempts {
+		logger.WithFields(logrus.Fields{
+			"attempts":       attempts,
+			"cookie_domain":  cookieDomain(r),
+			"insecure":       config.InsecureCookie,
+			"forwarded_host": r.Header.Get("X-Forwarded-Host"),
+		}).Error("Login loop detected, the auth cookie is not being kept, check cookie-domain and insecure-cookie match how the service is accessed and that the clock is correct")
+		SetCSRFCookie(w, ClearLoginAttemptsCookie(r))
+		s.loginLoopPage(logger, w, attempts)
+		return
+	}
+
+	// Return to the requested URL after login, unless the rule says otherwise
+	redirect := returnUrl(r)
+	if conf, ok := config.Rules[rule]; ok && conf.PostLoginRedirect != "" {
+		redirect = conf.PostLoginRedirect
+	}
+
 	// Set the CSRF cookie
-	http.SetCookie(w, MakeCSRFCookie(r, nonce))
+	maxAge, hasMaxAge := loginMaxAge(r, rule)
+	SetCSRFCookie(w, makeCSRFCookie(r, nonce, maxAge, hasMaxAge))
+
+	// Show login page if configured
+	if config.LoginPageTemplate != nil {
+		logger.Debug("Set CSRF cookie and rendering login page")
+		s.loginPage(logger, w, r, rule, nonce, redirect)
+		return
+	}
+
 	logger.Debug("Set CSRF cookie and redirecting to google login")
 
 	// Forward them on
-	http.Redirect(w, r, GetLoginURL(r, nonce), http.StatusTemporaryRedirect)
+	http.Redirect(w, r, getLoginURL(r, rule, nonce, redirect, config.RememberMe), http.StatusTemporaryRedirect)
 
 	logger.Debug("Done")
 	return
 }
 
+// Data available to the login page template
+type loginPageData struct {
+	LoginURL         string
+	RememberLoginURL string
+	SessionLoginURL  string
+	Host             string
+	Path             string
+	Rule             string
+	Provider         string
+}
+
+func (s *Server) loginPage(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, rule, nonce, redirect string) {
+	var body bytes.Buffer
+	err := config.LoginPageTemplate.Execute(&body, loginPageData{
+		LoginURL:         getLoginURL(r, rule, nonce, redirect, config.RememberMe),
+		RememberLoginURL: getLoginURL(r, rule, nonce, redirect, true),
+		SessionLoginURL:  getLoginURL(r, rule, nonce, redirect, false),
+		Host:             r.Host,
+		Path:             r.URL.Path,
+		Rule:             rule,
+		Provider:         config.ruleProvider(rule),
+	})
+	if err != nil {
+		logger.Errorf("Error rendering login page, %v", err)
+		http.Error(w, "Service unavailable", 503)
+		return
+	}
+
+	// Must not be a 2xx, otherwise traefik would allow the request
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(401)
+	body.WriteTo(w)
+}
+
+var loginLoopTemplate = template.Must(template.New("loop").Parse(`<!DOCTYPE html>
+<html>
+  <head><title>Unable to sign in</title></head>
+  <body>
+    <p>You have signed in {{.Attempts}} times, but your browser isn't keeping the session.</p>
+    <p>This is usually caused by a misconfiguration, please contact your administrator. Reloading this page will try again.</p>
+  </body>
+</html>
+`))
+
+// Data available to the login loop template
+type loginLoopData struct {
+	Attempts int
+}
+
+func (s *Server) loginLoopPage(logger *logrus.Entry, w http.ResponseWriter, attempts int) {
+	var body bytes.Buffer
+	err := loginLoopTemplate.Execute(&body, loginLoopData{
+		Attempts: attempts,
+	})
+	if err != nil {
+		logger.Errorf("Error rendering login loop page, %v", err)
+		http.Error(w, "Service unavailable", 503)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(500)
+	body.WriteTo(w)
+}
+
+var logoutConfirmTemplate = template.Must(template.New("logout").Parse(`<!DOCTYPE html>
+<html>
+  <head><title>Log out</title></head>
+  <body>
+    <form method="post" action="{{.LogoutURL}}{{with .CSRFToken}}?csrf_token={{.}}{{end}}">
+      <p>Are you sure you want to log out{{with .Email}} {{.}}{{end}}?</p>
+      <button type="submit">Log out</button>
+    </form>
+  </body>
+</html>
+`))
+
+// Data available to the logout confirmation template
+type logoutConfirmData struct {
+	LogoutURL string
+	Host      string
+	Email     string
+	CSRFToken string
+}
+
+func (s *Server) logoutConfirmPage(logger *logrus.Entry, w http.ResponseWriter, r *http.Request) {
+	data := logoutConfirmData{
+		LogoutURL: config.Path + "/logout",
+		Host:      r.Host,
+	}
+	if c, err := r.Cookie(config.CookieName); err == nil {
+		data.CSRFToken = logoutToken(c)
+		if email, err := ValidateCookie(r, c); err == nil {
+			data.Email = maskEmail(email)
+		}
+	}
+
+	var body bytes.Buffer
+	err := logoutConfirmTemplate.Execute(&body, data)
+	if err != nil {
+		logger.Errorf("Error rendering logout confirmation page, %v", err)
+		http.Error(w, "Service unavailable", 503)
+		return
+	}
+
+	// Must not be a 2xx, otherwise traefik would allow the request
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(401)
+	body.WriteTo(w)
+}
+
 func (s *Server) logger(r *http.Request, rule, msg string) *logrus.Entry {
 	// Create logger
 	logger := log.WithFields(logrus.Fields{
-		"source_ip": r.Header.Get("X-Forwarded-For"),
+		"source_ip": sourceIP(r),
+		"provider":  config.ruleProvider(rule),
 	})
 
 	// Log request
-	logger.WithFields(logrus.Fields{
-		"rule":    rule,
-		"headers": r.Header,
-	}).Debug(msg)
+	if logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		logger.WithFields(logrus.Fields{
+			"rule":    rule,
+			"headers": redactHeaders(r.Header),
+		}).Debug(msg)
+	}
 
 	return logger
 }
+
+// Headers that are always redacted when logged
+var redactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// Copy headers for logging, replacing the values of sensitive headers
+func redactHeaders(h http.Header) http.Header {
+	redacted := make(http.Header, len(h))
+	for name, values := range h {
+		redacted[name] = values
+	}
+
+	for _, names := range [][]string{redactedHeaders, config.LogRedactHeaders} {
+		for _, name := range names {
+			name = http.CanonicalHeaderKey(name)
+			if _, ok := redacted[name]; ok {
+				redacted[name] = []string{"[REDACTED]"}
+			}
+		}
+	}
+
+	return redacted
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -88,63 +89,1569 @@ func TestServerAuthHandlerExpired(t *testing.T) {
 	assert.Equal("/o/oauth2/auth", fwd.Path, "request with expired cookie should be redirected to google")
 }
 
+func TestServerAuthHandlerWebsocket(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	// Should deny websocket upgrade without cookie
+	req := newDefaultHttpRequest("/ws")
+	req.Header.Set("Upgrade", "websocket")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode, "websocket upgrade should not be redirected")
+	assert.Len(res.Cookies(), 0, "websocket upgrade should not set csrf cookie")
+
+	// Should deny websocket upgrade with expired cookie
+	config.Lifetime = time.Second * time.Duration(-1)
+	req = newDefaultHttpRequest("/ws")
+	req.Header.Set("Upgrade", "WebSocket")
+	c := MakeCookie(req, "test@example.com")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "websocket upgrade with expired cookie should not be redirected")
+
+	// Should redirect websocket upgrade when disabled
+	config, _ = NewConfig([]string{"--websocket-no-redirect=false"})
+	req = newDefaultHttpRequest("/ws")
+	req.Header.Set("Upgrade", "websocket")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "websocket upgrade should be redirected when disabled")
+}
+
+func TestServerAuthHandlerBoundCookie(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--bind-cookie-to=ip"})
+
+	req := newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	c := MakeCookie(req, "test@example.com")
+
+	// Should allow same client
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "same client should be allowed")
+
+	// Should require login from another client
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "other client should be redirected to login")
+}
+
+func TestServerAuthHandlerIdle(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--session-idle-timeout=60"})
+
+	// Should redirect idle cookie
+	req := newDefaultHttpRequest("/foo")
+	expires := time.Now().Add(time.Hour)
+	activity := fmt.Sprintf("%d", time.Now().Add(-2*time.Minute).Unix())
+	mac := cookieSignature(req, "test@example.com", fmt.Sprintf("%d", expires.Unix()), activity)
+	c := MakeCookie(req, "test@example.com")
+	c.Value = fmt.Sprintf("%s|%d|test@example.com|%s", mac, expires.Unix(), activity)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "request with idle cookie should be redirected")
+
+	// Should refresh activity
+	req = newDefaultHttpRequest("/foo")
+	activity = fmt.Sprintf("%d", time.Now().Add(-30*time.Second).Unix())
+	mac = cookieSignature(req, "test@example.com", fmt.Sprintf("%d", expires.Unix()), activity)
+	c.Value = fmt.Sprintf("%s|%d|test@example.com|%s", mac, expires.Unix(), activity)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "request with active cookie should be redirected to refresh it")
+	assert.Equal("https://example.com/foo", res.Header.Get("Location"), "should redirect back to the same URL")
+	var refreshed *http.Cookie
+	for _, rc := range res.Cookies() {
+		if rc.Name == config.CookieName && rc.Value != c.Value {
+			refreshed = rc
+		}
+	}
+	if assert.NotNil(refreshed, "cookie should be refreshed") {
+		assert.Equal(expires.Unix(), refreshed.Expires.Unix(), "refreshed cookie should keep expiry")
+	}
+
+	// Should allow requests that can't be repeated without refreshing
+	req = newHttpRequest("POST", "http://example.com/", "/foo")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "POST with active cookie should be allowed")
+	assert.Empty(res.Header["Set-Cookie"], "POST should not set a cookie")
+
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("Upgrade", "websocket")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "upgrade with active cookie should be allowed")
+
+	// Should not refresh recent activity
+	req = newDefaultHttpRequest("/foo")
+	c = MakeCookie(req, "test@example.com")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "request with active cookie should be allowed")
+	assert.Empty(res.Header["Set-Cookie"], "recent activity should not set a cookie")
+}
+
+func TestServerAuthHandlerLoginPage(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--login-page-template=../test/login-page.html",
+	})
+
+	// Should render login page rather than redirect
+	req := newDefaultHttpRequest("/foo")
+	res, body := doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode, "login page should not allow request")
+	assert.Equal("text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Contains(body, "Continue to sign in")
+	assert.Contains(body, "https://accounts.google.com/o/oauth2/auth?", "login page should link to google")
+	assert.Contains(body, "Access to example.com/foo is monitored.", "login page should have request host and path")
+	assert.Contains(body, "Sign in with google", "login page should have provider")
+
+	// Should set CSRF cookie
+	var cookie *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == config.CSRFCookieName {
+			cookie = c
+		}
+	}
+	if assert.NotNil(cookie) {
+		nonce := strings.Split(cookie.Value, "|")[0]
+		assert.Contains(body, nonce, "login url state should contain nonce")
+		assert.Contains(body, url.QueryEscape(nonce+":s:"), "login page should offer session login")
+	}
+}
+
 func TestServerAuthHandlerValid(t *testing.T) {
 	assert := assert.New(t)
 	config, _ = NewConfig([]string{})
 
-	// Should allow valid request email
+	// Should allow valid request email
+	req := newDefaultHttpRequest("/foo")
+	c := MakeCookie(req, "test@example.com")
+	config.Domains = []string{}
+
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "valid request should be allowed")
+
+	// Should pass through user
+	users := res.Header["X-Forwarded-User"]
+	assert.Len(users, 1, "valid request should have X-Forwarded-User header")
+	assert.Equal([]string{"test@example.com"}, users, "X-Forwarded-User header should match user")
+
+	// Should not reissue cookie
+	assert.Empty(res.Header["Set-Cookie"], "valid request should not set a cookie")
+}
+
+func TestServerAuthHandlerTrustedUser(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--trust-forwarded-user-header",
+		"--trusted-proxy=10.0.0.0/8",
+	})
+
+	// Should ignore header from untrusted peer
+	req := newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "10.0.0.1, 1.2.3.4")
+	req.Header.Add("X-Forwarded-User", "test@example.com")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "untrusted user header should be ignored")
+
+	// Should accept header from trusted peer
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+	req.Header.Add("X-Forwarded-User", "test@example.com")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "trusted user header should be allowed")
+	assert.Equal("test@example.com", res.Header.Get("X-Forwarded-User"))
+
+	// Should still validate email
+	config.Domains = []string{"test.com"}
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "10.0.0.1")
+	req.Header.Add("X-Forwarded-User", "test@example.com")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode, "invalid email should not be authorised")
+
+	// Should ignore header when disabled
+	config.TrustForwardedUserHeader = false
+	config.Domains = []string{}
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "10.0.0.1")
+	req.Header.Add("X-Forwarded-User", "test@example.com")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "user header should be ignored when disabled")
+}
+
+func TestServerAuthHandlerMaxAge(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--trust-auth-max-age-header",
+		"--trusted-proxy=10.0.0.0/8",
+	})
+
+	// Cookie issued two hours ago
+	req := newDefaultHttpRequest("/foo")
+	c := MakeCookie(req, "test@example.com")
+	config.Lifetime += 2 * time.Hour
+
+	// Should require login when session is too old
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+	req.Header.Add("X-Auth-Max-Age", "3600")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "old session should require login")
+	fwd, _ := res.Location()
+	assert.Equal("accounts.google.com", fwd.Host)
+	assert.Equal("3600", fwd.Query().Get("max_age"), "provider should be asked to re-authenticate")
+	assert.Equal("login", fwd.Query().Get("prompt"), "provider should be asked to prompt for login")
+
+	// Should allow recent enough session
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+	req.Header.Add("X-Auth-Max-Age", "10800")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "recent session should be allowed")
+
+	// Should ignore header from untrusted peer
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "10.0.0.1, 1.2.3.4")
+	req.Header.Add("X-Auth-Max-Age", "3600")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "untrusted max age should be ignored")
+
+	// Should ignore header when disabled
+	config.TrustAuthMaxAgeHeader = false
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+	req.Header.Add("X-Auth-Max-Age", "3600")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "max age should be ignored when disabled")
+
+	// Should allow session from the login a zero max age caused
+	config.TrustAuthMaxAgeHeader = true
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+	req.Header.Add("X-Auth-Max-Age", "0")
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(200, res.StatusCode, "new session should be allowed with zero max age")
+
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+	req.Header.Add("X-Auth-Max-Age", "0")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "old session should require login with zero max age")
+}
+
+func TestServerAuthHandlerRuleMaxAge(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--rule.admin.rule=PathPrefix(`/admin`)",
+		"--rule.admin.max-age=3600",
+	})
+
+	// Cookie issued two hours ago
+	req := newDefaultHttpRequest("/foo")
+	c := MakeCookie(req, "test@example.com")
+	config.Lifetime += 2 * time.Hour
+
+	// Should require login for rule when session is too old
+	req = newDefaultHttpRequest("/admin/delete")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "old session should require login")
+	fwd, _ := res.Location()
+	assert.Equal("3600", fwd.Query().Get("max_age"), "provider should be asked to re-authenticate")
+	assert.Contains(fwd.Query().Get("state"), ":m3600:", "max age should be in state")
+
+	// Should allow same session for other requests
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "other requests should be allowed")
+}
+
+func TestServerAuthHandlerRequireHTTPS(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--require-https",
+		"--rule.1.action=allow",
+		"--rule.1.rule=PathPrefix(`/health`)",
+	})
+
+	// Should redirect plaintext GET to https
+	req := newHttpRequest("GET", "http://example.com/", "/foo?q=1")
+	req.Header.Add("X-Forwarded-Proto", "http")
+	res, _ := doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(307, res.StatusCode, "plaintext request should be redirected")
+	fwd, _ := res.Location()
+	assert.Equal("https://example.com/foo?q=1", fwd.String())
+
+	// Should redirect to normalised host
+	req = newHttpRequest("GET", "http://Example.com./", "/foo")
+	req.Header.Add("X-Forwarded-Proto", "http")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "plaintext request should be redirected")
+	fwd, _ = res.Location()
+	assert.Equal("https://example.com/foo", fwd.String())
+
+	// Should deny plaintext request without a host
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Add("X-Forwarded-Proto", "http")
+	req.Header.Add("X-Forwarded-Uri", "/foo")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(403, res.StatusCode, "plaintext request without host should be denied")
+
+	// Should deny plaintext POST
+	req = newHttpRequest("POST", "http://example.com/", "/foo")
+	req.Header.Add("X-Forwarded-Proto", "http")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(403, res.StatusCode, "plaintext POST should be denied")
+
+	// Should authenticate https request
+	req = newHttpRequest("GET", "https://example.com/", "/foo")
+	req.Header.Add("X-Forwarded-Proto", "https")
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(200, res.StatusCode, "https request should be authenticated")
+
+	// Should not affect allow rules
+	req = newHttpRequest("GET", "http://example.com/", "/health")
+	req.Header.Add("X-Forwarded-Proto", "http")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "allow rule should not require https")
+}
+
+func TestServerAuthHandlerPostLoginRedirect(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--rule.kiosk.action=auth",
+		"--rule.kiosk.rule=Host(`kiosk.example.com`)",
+		"--rule.kiosk.post-login-redirect=https://kiosk.example.com/dashboard",
+	})
+
+	// Should return to rule's redirect
+	req := newHttpRequest("GET", "https://kiosk.example.com/", "/deep/link")
+	req.Header.Add("X-Forwarded-Proto", "https")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "request should require auth")
+	fwd, _ := res.Location()
+	assert.True(strings.HasSuffix(fwd.Query().Get("state"), ":https://kiosk.example.com/dashboard"), "state should contain rule's redirect")
+
+	// Should return to requested URL for other rules
+	req = newHttpRequest("GET", "https://app.example.com/", "/deep/link")
+	req.Header.Add("X-Forwarded-Proto", "https")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "request should require auth")
+	fwd, _ = res.Location()
+	assert.True(strings.HasSuffix(fwd.Query().Get("state"), ":https://app.example.com/deep/link"), "state should contain requested URL")
+}
+
+func TestServerAuthHandlerSkipAuthUserAgent(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--skip-auth-user-agent=/^kube-probe\\//",
+	})
+
+	// Should allow matching agent
+	req := newDefaultHttpRequest("/foo")
+	req.Header.Set("User-Agent", "kube-probe/1.18")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "skipped user agent should be allowed")
+	assert.Empty(res.Header.Get("X-Forwarded-User"), "skipped user agent should have no user")
+
+	// Should require auth for other agents
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("User-Agent", "curl/7.64.0")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "other user agent should require auth")
+}
+
+func TestServerAuthCallback(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	// Setup token server
+	tokenServerHandler := &TokenServerHandler{}
+	tokenServer := httptest.NewServer(tokenServerHandler)
+	defer tokenServer.Close()
+	tokenUrl, _ := url.Parse(tokenServer.URL)
+	config.Providers.Google.TokenURL = tokenUrl
+
+	// Setup user server
+	userServerHandler := &UserServerHandler{}
+	userServer := httptest.NewServer(userServerHandler)
+	defer userServer.Close()
+	userUrl, _ := url.Parse(userServer.URL)
+	config.Providers.Google.UserURL = userUrl
+
+	// Should pass auth response request to callback
+	req := newDefaultHttpRequest("/_oauth")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode, "auth callback without cookie shouldn't be authorised")
+
+	// Should catch invalid csrf cookie
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "nononononononononononononononono")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "auth callback with invalid cookie shouldn't be authorised")
+
+	// Should redirect valid request
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "valid auth callback should be allowed")
+
+	fwd, _ := res.Location()
+	assert.Equal("http", fwd.Scheme, "valid request should be redirected to return url")
+	assert.Equal("example.com", fwd.Host, "valid request should be redirected to return url")
+	assert.Equal("/redirect", fwd.Path, "valid request should be redirected to return url")
+}
+
+func TestServerAuthCallbackFormPost(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--providers.google.response-mode=form_post",
+	})
+
+	tokenServer := httptest.NewServer(&TokenServerHandler{})
+	defer tokenServer.Close()
+	config.Providers.Google.TokenURL, _ = url.Parse(tokenServer.URL)
+
+	userServer := httptest.NewServer(&UserServerHandler{})
+	defer userServer.Close()
+	config.Providers.Google.UserURL, _ = url.Parse(userServer.URL)
+
+	// Should accept callback routed directly with params in the body
+	form := url.Values{
+		"code":  {"code"},
+		"state": {"12345678901234567890123456789012:http://example.com/redirect"},
+	}
+	req := httptest.NewRequest("POST", "http://example.com/_oauth", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-Host", "example.com")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "valid form post callback should be allowed")
+	fwd, _ := res.Location()
+	assert.Equal("/redirect", fwd.Path, "valid request should be redirected to return url")
+
+	// Should still accept callback with params in the query
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "valid query callback should be allowed")
+}
+
+func TestServerLoginLoop(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--max-login-attempts=3"})
+
+	tokenServer := httptest.NewServer(&TokenServerHandler{})
+	defer tokenServer.Close()
+	config.Providers.Google.TokenURL, _ = url.Parse(tokenServer.URL)
+
+	userServer := httptest.NewServer(&UserServerHandler{})
+	defer userServer.Close()
+	config.Providers.Google.UserURL, _ = url.Parse(userServer.URL)
+
+	findAttemptsCookie := func(res *http.Response) *http.Cookie {
+		for _, c := range res.Cookies() {
+			if c.Name == config.CSRFCookieName+"_attempts" {
+				return c
+			}
+		}
+		return nil
+	}
+
+	// Should count logins
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode)
+	if attempts := findAttemptsCookie(res); assert.NotNil(attempts) {
+		assert.Equal("1", attempts.Value)
+		assert.Equal("/", attempts.Path, "attempts cookie should be sent with every request")
+	}
+
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	req.AddCookie(MakeLoginAttemptsCookie(req, 2))
+	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode)
+	if attempts := findAttemptsCookie(res); assert.NotNil(attempts) {
+		assert.Equal("3", attempts.Value)
+	}
+
+	// Should redirect to login below the limit
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, MakeLoginAttemptsCookie(req, 2))
+	assert.Equal(307, res.StatusCode, "login below limit should be redirected")
+
+	// Should show error page at the limit
+	req = newDefaultHttpRequest("/foo")
+	res, body := doHttpRequest(req, MakeLoginAttemptsCookie(req, 3))
+	assert.Equal(500, res.StatusCode, "login loop should not be redirected")
+	assert.Contains(body, "You have signed in 3 times")
+	if attempts := findAttemptsCookie(res); assert.NotNil(attempts) {
+		assert.Equal("", attempts.Value, "attempts should be cleared to allow retry")
+	}
+
+	// Should restart counting when a login is made with a kept auth cookie
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	req.AddCookie(MakeLoginAttemptsCookie(req, 2))
+	req.AddCookie(MakeCookie(req, "test@example.com"))
+	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode)
+	if attempts := findAttemptsCookie(res); assert.NotNil(attempts) {
+		assert.Equal("1", attempts.Value, "attempts should restart with a kept auth cookie")
+	}
+
+	// Should not show error page when the auth cookie is kept, e.g. when a
+	// rule's max age requires repeated logins
+	config.Rules["admin"] = &Rule{Action: "auth", Rule: "PathPrefix(`/admin`)", Provider: "google", MaxAge: 1}
+	req = newDefaultHttpRequest("/admin")
+	req.AddCookie(MakeLoginAttemptsCookie(req, 3))
+	old := MakeCookie(req, "test@example.com")
+	config.Lifetime += time.Hour
+	res, _ = doHttpRequest(req, old)
+	config.Lifetime -= time.Hour
+	assert.Equal(307, res.StatusCode, "login with kept auth cookie should be redirected")
+	if attempts := findAttemptsCookie(res); assert.NotNil(attempts) {
+		assert.Equal("", attempts.Value, "attempts should be cleared")
+	}
+	delete(config.Rules, "admin")
+
+	// Should not clear attempts on allowed requests, traefik drops the cookie
+	req = newDefaultHttpRequest("/foo")
+	req.AddCookie(MakeLoginAttemptsCookie(req, 2))
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(200, res.StatusCode)
+	assert.Nil(findAttemptsCookie(res))
+
+	// Should not count logins when disabled
+	config.MaxLoginAttempts = 0
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode)
+	assert.Nil(findAttemptsCookie(res))
+}
+
+func TestServerAuthCallbackOrigin(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--check-callback-origin"})
+	config.Providers.Google.LoginURL, _ = url.Parse("https://accounts.google.com/o/oauth2/auth")
+
+	tokenServer := httptest.NewServer(&TokenServerHandler{})
+	defer tokenServer.Close()
+	config.Providers.Google.TokenURL, _ = url.Parse(tokenServer.URL)
+	userServer := httptest.NewServer(&UserServerHandler{})
+	defer userServer.Close()
+	config.Providers.Google.UserURL, _ = url.Parse(userServer.URL)
+
+	newCallbackRequest := func(header, origin string) *http.Request {
+		req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+		if header != "" {
+			req.Header.Set(header, origin)
+		}
+		return req
+	}
+
+	// Should allow callbacks from the provider
+	req := newCallbackRequest("Referer", "https://accounts.google.com/")
+	res, _ := doHttpRequest(req, MakeCSRFCookie(req, "12345678901234567890123456789012"))
+	assert.Equal(307, res.StatusCode, "callback from provider should be allowed")
+
+	req = newCallbackRequest("Origin", "https://accounts.google.com")
+	res, _ = doHttpRequest(req, MakeCSRFCookie(req, "12345678901234567890123456789012"))
+	assert.Equal(307, res.StatusCode, "form post from provider should be allowed")
+
+	// Should fall back to the csrf cookie without Origin or Referer
+	req = newCallbackRequest("", "")
+	res, _ = doHttpRequest(req, MakeCSRFCookie(req, "12345678901234567890123456789012"))
+	assert.Equal(307, res.StatusCode, "callback without origin should be allowed")
+
+	// Should reject callbacks from other origins, without using the csrf cookie
+	req = newCallbackRequest("Referer", "https://evil.com/page")
+	res, _ = doHttpRequest(req, MakeCSRFCookie(req, "12345678901234567890123456789012"))
+	assert.Equal(403, res.StatusCode, "callback from other origin should be forbidden")
+	assert.Len(res.Cookies(), 0, "csrf cookie should not be cleared")
+
+	// Should not check origin by default
+	config.CheckCallbackOrigin = false
+	req = newCallbackRequest("Referer", "https://evil.com/page")
+	res, _ = doHttpRequest(req, MakeCSRFCookie(req, "12345678901234567890123456789012"))
+	assert.Equal(307, res.StatusCode, "origin should not be checked by default")
+}
+
+func TestServerAuthCallbackReuseSession(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--callback-reuse-session"})
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		fmt.Fprint(w, `{"error":"invalid_grant"}`)
+	}))
+	defer tokenServer.Close()
+	config.Providers.Google.TokenURL, _ = url.Parse(tokenServer.URL)
+
+	state := "12345678901234567890123456789012:s:http://example.com/redirect"
+
+	// Should redirect repeated callback with existing session
+	req := newDefaultHttpRequest("/_oauth?state=" + url.QueryEscape(state))
+	res, _ := doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(307, res.StatusCode, "callback without csrf cookie should reuse session")
+	fwd, _ := res.Location()
+	assert.Equal("http://example.com/redirect", fwd.String())
+
+	req = newDefaultHttpRequest("/_oauth?state=" + url.QueryEscape(state))
+	req.AddCookie(MakeCSRFCookie(req, "12345678901234567890123456789012"))
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(307, res.StatusCode, "failed code exchange should reuse session")
+	fwd, _ = res.Location()
+	assert.Equal("http://example.com/redirect", fwd.String())
+
+	// Should not reuse an invalid session
+	req = newDefaultHttpRequest("/_oauth?state=" + url.QueryEscape(state))
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode, "callback without session should not be redirected")
+
+	req = newDefaultHttpRequest("/_oauth?state=" + url.QueryEscape(state))
+	c := MakeCookie(req, "test@example.com")
+	c.Value += "x"
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "callback with invalid session should not be redirected")
+
+	req = newDefaultHttpRequest("/_oauth?state=" + url.QueryEscape(state))
+	req.AddCookie(MakeCSRFCookie(req, "12345678901234567890123456789012"))
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(503, res.StatusCode, "failed code exchange without session should error")
+
+	// Should not redirect to disallowed domains
+	req = newDefaultHttpRequest("/_oauth?state=" + url.QueryEscape("12345678901234567890123456789012:http://evil.com/"))
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(401, res.StatusCode, "disallowed redirect should not be followed")
+
+	// Should not reuse session by default
+	config.CallbackReuseSession = false
+	req = newDefaultHttpRequest("/_oauth?state=" + url.QueryEscape(state))
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(401, res.StatusCode, "session should not be reused by default")
+}
+
+func TestServerAuthFailureLimit(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--auth-failure-limit=2",
+		"--whitelist=allowed@example.com",
+	})
+
+	tokenServer := httptest.NewServer(&TokenServerHandler{})
+	defer tokenServer.Close()
+	config.Providers.Google.TokenURL, _ = url.Parse(tokenServer.URL)
+	email := "example@example.com"
+	userServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"1","email":"%s"}`, email)
+	}))
+	defer userServer.Close()
+	config.Providers.Google.UserURL, _ = url.Parse(userServer.URL)
+
+	s := NewServer()
+	callback := func(ip string) *http.Response {
+		req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+		req.Header.Set("X-Forwarded-For", ip)
+		req.AddCookie(MakeCSRFCookie(req, "12345678901234567890123456789012"))
+		w := httptest.NewRecorder()
+		s.RootHandler(w, req)
+		return w.Result()
+	}
+
+	// Should count logins of users that aren't allowed
+	assert.Equal(307, callback("1.1.1.1").StatusCode)
+	assert.Equal(307, callback("1.1.1.1").StatusCode)
+
+	// Should block client
+	res := callback("1.1.1.1")
+	assert.Equal(429, res.StatusCode, "client should be blocked at limit")
+	assert.Equal("900", res.Header.Get("Retry-After"))
+
+	// Should block user from another client
+	res = callback("2.2.2.2")
+	assert.Equal(429, res.StatusCode, "user should be blocked at limit")
+
+	// Should allow other users from other clients
+	email = "allowed@example.com"
+	res = callback("3.3.3.3")
+	assert.Equal(307, res.StatusCode, "other users should be allowed")
+	callback("3.3.3.3")
+	res = callback("3.3.3.3")
+	assert.Equal(307, res.StatusCode, "allowed logins should not be counted")
+
+	// Should not count clients without an IP together
+	email = "one@example.com"
+	callback("")
+	callback("")
+	email = "two@example.com"
+	res = callback("")
+	assert.Equal(307, res.StatusCode, "clients without an IP should not block each other")
+
+	// Should not count by default
+	config, _ = NewConfig([]string{"--whitelist=allowed@example.com"})
+	config.Providers.Google.TokenURL, _ = url.Parse(tokenServer.URL)
+	config.Providers.Google.UserURL, _ = url.Parse(userServer.URL)
+	email = "example@example.com"
+	s = NewServer()
+	for i := 0; i < 3; i++ {
+		assert.Equal(307, callback("1.1.1.1").StatusCode, "failures should not be counted by default")
+	}
+}
+
+func TestServerAuthCallbackMaxAge(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	tokenServer := httptest.NewServer(&TokenServerHandler{})
+	defer tokenServer.Close()
+	config.Providers.Google.TokenURL, _ = url.Parse(tokenServer.URL)
+
+	userServer := httptest.NewServer(&UserServerHandler{})
+	defer userServer.Close()
+	config.Providers.Google.UserURL, _ = url.Parse(userServer.URL)
+
+	state := "12345678901234567890123456789012:m60:http://example.com/redirect"
+
+	// Should allow a login made with a max age
+	req := newDefaultHttpRequest("/_oauth?state=" + url.QueryEscape(state))
+	c := makeCSRFCookie(req, "12345678901234567890123456789012", time.Minute, true)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "login with max age should be allowed")
+	fwd, _ := res.Location()
+	assert.Equal("/redirect", fwd.Path, "max age should be removed from redirect")
+
+	// Should reject max age removed from state
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	c = makeCSRFCookie(req, "12345678901234567890123456789012", time.Minute, true)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "max age removed from state should be rejected")
+	for _, c := range res.Cookies() {
+		assert.NotEqual(config.CookieName, c.Name, "auth cookie should not be set")
+	}
+
+	// Should reject max age changed in state
+	req = newDefaultHttpRequest("/_oauth?state=" + url.QueryEscape("12345678901234567890123456789012:m86400:http://example.com/redirect"))
+	c = makeCSRFCookie(req, "12345678901234567890123456789012", time.Minute, true)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "max age changed in state should be rejected")
+}
+
+func TestServerAuthCallbackSession(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	tokenServer := httptest.NewServer(&TokenServerHandler{})
+	defer tokenServer.Close()
+	config.Providers.Google.TokenURL, _ = url.Parse(tokenServer.URL)
+
+	userServer := httptest.NewServer(&UserServerHandler{})
+	defer userServer.Close()
+	config.Providers.Google.UserURL, _ = url.Parse(userServer.URL)
+
+	findAuthCookie := func(res *http.Response) *http.Cookie {
+		for _, c := range res.Cookies() {
+			if c.Name == config.CookieName {
+				return c
+			}
+		}
+		return nil
+	}
+
+	// Should set persistent cookie by default
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode)
+	if cookie := findAuthCookie(res); assert.NotNil(cookie) {
+		assert.False(cookie.Expires.IsZero(), "cookie should be persistent")
+	}
+
+	// Should set session cookie when login is not remembered
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:s:http://example.com/redirect")
+	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode)
+	fwd, _ := res.Location()
+	assert.Equal("/redirect", fwd.Path, "session marker should be removed from redirect")
+	if cookie := findAuthCookie(res); assert.NotNil(cookie) {
+		assert.True(cookie.Expires.IsZero(), "cookie should not be persistent")
+	}
+}
+
+func TestServerAuthCallbackInvalidRedirect(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	// Should reject redirect to another domain
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://evil.com/")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(400, res.StatusCode, "redirect to another domain should be rejected")
+	assert.Equal("", res.Header.Get("Location"))
+}
+
+func TestServerAuthCallbackProviderError(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	// Should tell user they cancelled
+	req := newDefaultHttpRequest("/_oauth?error=access_denied&state=12345678901234567890123456789012:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, body := doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode, "cancelled sign in should be forbidden")
+	assert.Equal("You cancelled sign in\n", body)
+
+	// Should report provider failures as unavailable
+	req = newDefaultHttpRequest("/_oauth?error=temporarily_unavailable&error_description=down&state=12345678901234567890123456789012:http://example.com/redirect")
+	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(503, res.StatusCode, "provider failure should be unavailable")
+
+	// Should reject other errors
+	req = newDefaultHttpRequest("/_oauth?error=invalid_scope&state=12345678901234567890123456789012:http://example.com/redirect")
+	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "other errors should not be authorised")
+}
+
+func TestServerAuthCallbackUserError(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	tokenServer := httptest.NewServer(&TokenServerHandler{})
+	defer tokenServer.Close()
+	config.Providers.Google.TokenURL, _ = url.Parse(tokenServer.URL)
+
+	userServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Backend Error", 500)
+	}))
+	defer userServer.Close()
+	config.Providers.Google.UserURL, _ = url.Parse(userServer.URL)
+
+	// Should respond with retriable error
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, body := doHttpRequest(req, c)
+	assert.Equal(503, res.StatusCode, "userinfo failure should be unavailable")
+	assert.Equal("Service unavailable\n", body)
+	for _, cookie := range res.Cookies() {
+		assert.NotEqual(config.CookieName, cookie.Name, "should not set auth cookie")
+	}
+}
+
+func TestServerAuthCallbackHostedDomain(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--providers.google.hosted-domain=test.com",
+	})
+
+	// Setup token server
+	tokenServerHandler := &TokenServerHandler{}
+	tokenServer := httptest.NewServer(tokenServerHandler)
+	defer tokenServer.Close()
+	tokenUrl, _ := url.Parse(tokenServer.URL)
+	config.Providers.Google.TokenURL = tokenUrl
+
+	// Setup user server
+	userServerHandler := &UserServerHandler{}
+	userServer := httptest.NewServer(userServerHandler)
+	defer userServer.Close()
+	userUrl, _ := url.Parse(userServer.URL)
+	config.Providers.Google.UserURL = userUrl
+
+	// Should reject user from another domain
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode, "user from another domain should be forbidden")
+}
+
+func TestServerAuthCallbackUserinfoTooLarge(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--providers.google.max-userinfo-bytes=50",
+	})
+
+	// Setup token server
+	tokenServerHandler := &TokenServerHandler{}
+	tokenServer := httptest.NewServer(tokenServerHandler)
+	defer tokenServer.Close()
+	tokenUrl, _ := url.Parse(tokenServer.URL)
+	config.Providers.Google.TokenURL = tokenUrl
+
+	// Setup user server
+	userServerHandler := &UserServerHandler{}
+	userServer := httptest.NewServer(userServerHandler)
+	defer userServer.Close()
+	userUrl, _ := url.Parse(userServer.URL)
+	config.Providers.Google.UserURL = userUrl
+
+	// Should refuse to generate a cookie
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode, "user with large userinfo should be forbidden")
+
+	for _, c := range res.Cookies() {
+		assert.NotEqual(config.CookieName, c.Name, "auth cookie should not be set")
+	}
+}
+
+func TestServerAuthCallbackEmptyEmail(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	// Setup token server
+	tokenServerHandler := &TokenServerHandler{}
+	tokenServer := httptest.NewServer(tokenServerHandler)
+	defer tokenServer.Close()
+	tokenUrl, _ := url.Parse(tokenServer.URL)
+	config.Providers.Google.TokenURL = tokenUrl
+
+	// Setup user server that omits the email
+	userServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":"1","verified_email":false}`)
+	}))
+	defer userServer.Close()
+	userUrl, _ := url.Parse(userServer.URL)
+	config.Providers.Google.UserURL = userUrl
+
+	// Should refuse to generate a cookie
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode, "user without email should be forbidden")
+
+	for _, c := range res.Cookies() {
+		assert.NotEqual(config.CookieName, c.Name, "auth cookie should not be set")
+	}
+}
+
+func TestServerLogout(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+	config.CookieDomains = []CookieDomain{
+		*NewCookieDomain("example.com"),
+		*NewCookieDomain("test.org"),
+	}
+
+	req := newDefaultHttpRequest("/_oauth/logout")
+	c := MakeCookie(req, "test@example.com")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "should return a 401")
+
+	// Should clear the auth cookie on every domain, and any login in progress
+	var cleared []string
+	for _, c := range res.Cookies() {
+		assert.Equal("", c.Value, "cookie should be cleared")
+		assert.True(c.Expires.Before(time.Now()), "cookie should be expired")
+		cleared = append(cleared, c.Name+" "+c.Domain+c.Path)
+	}
+	assert.Equal([]string{
+		"_forward_auth example.com/",
+		"_forward_auth test.org/",
+		"_forward_auth_csrf example.com/_oauth",
+		"_forward_auth_csrf_attempts example.com/",
+	}, cleared)
+
+	// Should replace cookies set before logout
+	w := httptest.NewRecorder()
+	http.SetCookie(w, &http.Cookie{Name: "other", Value: "value"})
+	req = newDefaultHttpRequest("/_oauth/logout")
+	NewServer().RootHandler(w, req)
+	for _, c := range w.Result().Cookies() {
+		assert.NotEqual("other", c.Name, "cookie set before logout should be removed")
+	}
+}
+
+func TestServerLogoutRedirect(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--cookie-domain=example.com",
+		"--rule.app.rule=Host(`app.example.com`)",
+		"--rule.app.logout-redirect=https://app.example.com/goodbye",
+	})
+
+	// Should redirect logouts matching a rule with a logout-redirect
+	req := newHttpRequest("GET", "https://app.example.com/", "/_oauth/logout")
+	c := MakeCookie(req, "test@example.com")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(303, res.StatusCode, "should redirect logout")
+	fwd, _ := res.Location()
+	assert.Equal("https://app.example.com/goodbye", fwd.String())
+	assert.NotEmpty(res.Cookies(), "should still clear cookies")
+
+	// Should not redirect logouts matching other rules
+	req = newHttpRequest("GET", "https://other.example.com/", "/_oauth/logout")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "should not redirect logout from other hosts")
+
+	// Should only allow the host logged out from without redirect domains
+	config, _ = NewConfig([]string{
+		"--rule.app.rule=Host(`app.example.com`) || Host(`www.example.com`)",
+		"--rule.app.logout-redirect=https://app.example.com/goodbye",
+	})
+	req = newHttpRequest("GET", "https://app.example.com/", "/_oauth/logout")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(303, res.StatusCode, "should redirect logout to the same host")
+
+	req = newHttpRequest("GET", "https://www.example.com/", "/_oauth/logout")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "should not redirect logout to another host")
+}
+
+func TestServerLogoutRequirePost(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--logout-require-post"})
+
+	// Should show confirmation page for GET
+	req := newHttpRequest("GET", "http://example.com/", "/_oauth/logout")
+	c := MakeCookie(req, "test@example.com")
+	res, body := doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "confirmation page should not allow request")
+	assert.Contains(body, `<form method="post" action="/_oauth/logout?csrf_token=`+logoutToken(c)+`">`)
+	assert.Contains(body, "log out t***@example.com?", "confirmation page should have masked email")
+	for _, c := range res.Cookies() {
+		assert.NotEqual("", c.Value, "cookie should not be cleared on GET")
+	}
+
+	// Should reject POST without a token
+	req = newHttpRequest("POST", "http://example.com/", "/_oauth/logout")
+	c = MakeCookie(req, "test@example.com")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode, "logout without token should be forbidden")
+	assert.Len(res.Cookies(), 0, "cookie should not be cleared without token")
+
+	// Should reject POST with a token for another cookie
+	other := MakeCookie(req, "other@example.com")
+	req = newHttpRequest("POST", "http://example.com/", "/_oauth/logout?csrf_token="+url.QueryEscape(logoutToken(other)))
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode, "logout with another cookie's token should be forbidden")
+
+	// Should logout on POST with token
+	req = newHttpRequest("POST", "http://example.com/", "/_oauth/logout?csrf_token="+url.QueryEscape(logoutToken(c)))
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode)
+	cookies := res.Cookies()
+	if assert.Len(cookies, 3) {
+		for _, c := range cookies {
+			assert.Equal("", c.Value, "cookie should be cleared on POST")
+		}
+	}
+}
+
+func TestServerMethodGuard(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	// Callback should only accept GET
+	req := newHttpRequest("POST", "http://example.com/", "/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(405, res.StatusCode, "callback should not accept POST")
+	assert.Equal("GET", res.Header.Get("Allow"))
+
+	// Logout should only accept GET by default
+	req = newHttpRequest("POST", "http://example.com/", "/_oauth/logout")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(405, res.StatusCode, "logout should not accept POST by default")
+
+	req = newHttpRequest("GET", "http://example.com/", "/_oauth/logout")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode, "logout should accept GET")
+
+	// Logout should accept GET and POST when POST is required
+	config.LogoutRequirePost = true
+	req = newHttpRequest("POST", "http://example.com/", "/_oauth/logout")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode, "logout should accept POST")
+
+	req = newHttpRequest("DELETE", "http://example.com/", "/_oauth/logout")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(405, res.StatusCode, "logout should not accept DELETE")
+	assert.Equal("GET, POST", res.Header.Get("Allow"))
+}
+
+func TestServerMaxConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--max-concurrent=1"})
+	config.DefaultAction = "allow"
+	s := NewServer()
+
+	// Should allow request below limit
+	w := httptest.NewRecorder()
+	s.RootHandler(w, newDefaultHttpRequest("/foo"))
+	assert.Equal(200, w.Code, "request below limit should be allowed")
+	assert.Len(s.inflight, 0, "request should release its slot")
+
+	// Should shed request at limit
+	s.inflight <- struct{}{}
+	w = httptest.NewRecorder()
+	s.RootHandler(w, newDefaultHttpRequest("/foo"))
+	assert.Equal(503, w.Code, "request at limit should be shed")
+	<-s.inflight
+
+	// Should have no limit by default
+	config.MaxConcurrent = 0
+	assert.Nil(NewServer().inflight)
+}
+
+func TestServerIPBlocklist(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--ip-blocklist=1.2.3.0/24",
+		"--trusted-proxy=10.0.0.0/8",
+	})
+	config.DefaultAction = "allow"
+
+	// Should deny blocked client
 	req := newDefaultHttpRequest("/foo")
-	c := MakeCookie(req, "test@example.com")
-	config.Domains = []string{}
+	req.Header.Add("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(403, res.StatusCode, "blocked client should be denied")
+
+	// Should allow other clients
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "unblocked client should be allowed")
+}
+
+func TestServerMaxHeaderBytes(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--max-header-bytes=1024",
+	})
 
+	// Should reject oversized cookie
+	req := newDefaultHttpRequest("/foo")
+	c := MakeCookie(req, "test@example.com")
+	c.Value += strings.Repeat("a", 1024)
 	res, _ := doHttpRequest(req, c)
-	assert.Equal(200, res.StatusCode, "valid request should be allowed")
+	assert.Equal(431, res.StatusCode, "oversized cookie should be rejected")
 
-	// Should pass through user
-	users := res.Header["X-Forwarded-User"]
-	assert.Len(users, 1, "valid request should have X-Forwarded-User header")
-	assert.Equal([]string{"test@example.com"}, users, "X-Forwarded-User header should match user")
+	// Should allow normal request
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(200, res.StatusCode, "normal request should be allowed")
 }
 
-func TestServerAuthCallback(t *testing.T) {
+func TestServerHeaderSize(t *testing.T) {
+	assert := assert.New(t)
+	h := http.Header{}
+	h.Add("X-Small", "a")
+	h.Add("Cookie", "abcdefghij")
+	h.Add("Cookie", "abc")
+
+	size, largest := headerSize(h)
+	assert.Equal(7+1+4+2*(6+4)+10+3, size)
+	assert.Equal("Cookie", largest)
+}
+
+func TestServerDenyCountry(t *testing.T) {
 	assert := assert.New(t)
 	config, _ = NewConfig([]string{})
+	config.GeoIP = fakeCountryLookup{"1.1.1.1": "GB"}
+	config.DenyCountries = CommaSeparatedList{"GB"}
 
-	// Setup token server
-	tokenServerHandler := &TokenServerHandler{}
-	tokenServer := httptest.NewServer(tokenServerHandler)
-	defer tokenServer.Close()
-	tokenUrl, _ := url.Parse(tokenServer.URL)
-	config.Providers.Google.TokenURL = tokenUrl
+	// Should deny before auth
+	req := newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "1.1.1.1")
+	res, _ := doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(403, res.StatusCode, "request from denied country should be denied")
 
-	// Setup user server
-	userServerHandler := &UserServerHandler{}
-	userServer := httptest.NewServer(userServerHandler)
-	defer userServer.Close()
-	userUrl, _ := url.Parse(userServer.URL)
-	config.Providers.Google.UserURL = userUrl
+	// Should allow other countries
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "2.2.2.2")
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(200, res.StatusCode, "request from other country should be allowed")
 
-	// Should pass auth response request to callback
-	req := newDefaultHttpRequest("/_oauth")
+	// Should deny requests without a client IP when only allowing countries
+	config.DenyCountries = nil
+	config.AllowCountries = CommaSeparatedList{"GB"}
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "1.1.1.1")
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(200, res.StatusCode, "request from allowed country should be allowed")
+
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(403, res.StatusCode, "request without client IP should be denied")
+
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Add("X-Forwarded-For", "not-an-ip")
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(403, res.StatusCode, "request with invalid client IP should be denied")
+}
+
+func TestServerFavicon(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	// Should require auth by default
+	req := newDefaultHttpRequest("/favicon.ico")
 	res, _ := doHttpRequest(req, nil)
-	assert.Equal(401, res.StatusCode, "auth callback without cookie shouldn't be authorised")
+	assert.Equal(307, res.StatusCode, "favicon should require auth by default")
+
+	// Should allow forwarded requests to the auth host without auth
+	config, _ = NewConfig([]string{
+		"--favicon=default",
+		"--auth-host=auth.example.com",
+		"--cookie-domain=example.com",
+	})
+	req = newHttpRequest("", "http://auth.example.com/", "/favicon.ico")
+	res, body := doHttpRequest(req, nil)
+	assert.Equal(204, res.StatusCode, "forwarded favicon request should be allowed")
+	assert.Equal("", body)
+
+	req = newHttpRequest("", "http://Auth.example.com.:443/", "/favicon.ico?v=2")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(204, res.StatusCode, "favicon with query should be allowed")
 
-	// Should catch invalid csrf cookie
-	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://redirect")
-	c := MakeCSRFCookie(req, "nononononononononononononononono")
+	req = newHttpRequest("", "http://auth.example.com/", "/other/favicon.ico")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "other paths should require auth")
+
+	// Should require auth for other hosts
+	req = newHttpRequest("", "http://app.example.com/", "/favicon.ico")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "app favicon should require auth")
+
+	// Should require auth for forwarded requests without an auth host
+	config, _ = NewConfig([]string{"--favicon=default"})
+	req = newDefaultHttpRequest("/favicon.ico")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "favicon without auth host should require auth")
+
+	// Should serve the icon to direct requests
+	req = httptest.NewRequest("GET", "http://auth.example.com/favicon.ico", nil)
+	req.Header.Set("X-Forwarded-Host", "auth.example.com")
+	res, body = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("image/x-icon", res.Header.Get("Content-Type"))
+	assert.Equal(string(defaultFavicon), body)
+}
+
+func TestServerMaintenance(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--maintenance",
+		"--rule.public.action=allow",
+		"--rule.public.rule=PathPrefix(`/public`)",
+	})
+
+	// Should show maintenance page rather than redirecting to login
+	req := newDefaultHttpRequest("/foo")
+	res, body := doHttpRequest(req, nil)
+	assert.Equal(503, res.StatusCode, "login should be unavailable")
+	assert.Equal("300", res.Header.Get("Retry-After"))
+	assert.Contains(body, "temporarily unavailable")
+	assert.Empty(res.Cookies(), "login should not be started")
+
+	// Should show maintenance page for callbacks
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://example.com/redirect")
+	res, _ = doHttpRequest(req, MakeCSRFCookie(req, "12345678901234567890123456789012"))
+	assert.Equal(503, res.StatusCode, "callback should be unavailable")
+
+	// Should still allow users with a session
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(200, res.StatusCode, "user with session should be allowed")
+
+	// Should still allow allow rules
+	req = newDefaultHttpRequest("/public")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "allow rule should be allowed")
+
+	// Should show custom page
+	config.MaintenancePage = []byte("<p>Back soon</p>")
+	config.MaintenanceRetryAfter = 60
+	req = newDefaultHttpRequest("/foo")
+	res, body = doHttpRequest(req, nil)
+	assert.Equal(503, res.StatusCode)
+	assert.Equal("60", res.Header.Get("Retry-After"))
+	assert.Equal("<p>Back soon</p>", body)
+}
+
+func TestServerForwardedHeaders(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--rule.root.action=allow",
+		"--rule.root.rule=Path(`/`)",
+	})
+
+	// Should treat missing uri as root
+	req := newDefaultHttpRequest("")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "missing uri should be treated as root")
+
+	// Should treat invalid uri as root
+	req = newDefaultHttpRequest("/%zz")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "invalid uri should be treated as root")
+
+	req = newDefaultHttpRequest("/foo\x7f\nbar")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "uri with control characters should be treated as root")
+
+	// Should reject when required
+	config.RequireForwardedHeaders = true
+	req = newDefaultHttpRequest("")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(400, res.StatusCode, "missing uri should be rejected")
+
+	req = newDefaultHttpRequest("/%zz")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(400, res.StatusCode, "invalid uri should be rejected")
+
+	req = newDefaultHttpRequest("/foo\x7f\nbar")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(400, res.StatusCode, "uri with control characters should be rejected")
+
+	req = newHttpRequest("", "", "/")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(400, res.StatusCode, "missing host should be rejected")
+
+	req = newDefaultHttpRequest("/")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "complete request should be allowed")
+}
+
+func TestServerDirectAccess(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--direct-access=info"})
+
+	// Should show info page without forwarded headers
+	req := httptest.NewRequest("GET", "http://auth.example.com/", nil)
+	res, body := doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode, "direct access should not allow request")
+	assert.Contains(body, "forward auth middleware")
+	assert.Len(res.Cookies(), 0, "direct access should not start login")
+
+	// Should respond with 404 when configured
+	config.DirectAccess = "not-found"
+	req = httptest.NewRequest("GET", "http://auth.example.com/", nil)
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(404, res.StatusCode, "direct access should not be found")
+
+	// Should handle forwarded requests as normal
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "forwarded request should be redirected to login")
+
+	// Should handle direct access as normal by default
+	config, _ = NewConfig([]string{})
+	req = httptest.NewRequest("GET", "http://auth.example.com/", nil)
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "direct access should be redirected to login by default")
+}
+
+func TestServerAllowForwardUser(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--rule.public.action=allow",
+		"--rule.public.rule=PathPrefix(`/public`)",
+	})
+
+	// Should not forward user by default
+	req := newDefaultHttpRequest("/public")
+	res, _ := doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(200, res.StatusCode)
+	assert.Empty(res.Header.Get("X-Forwarded-User"), "user should not be forwarded by default")
+
+	// Should forward user with valid cookie
+	config.AllowForwardUser = true
+	req = newDefaultHttpRequest("/public")
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("test@example.com", res.Header.Get("X-Forwarded-User"))
+
+	// Should still allow without a valid cookie
+	req = newDefaultHttpRequest("/public")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "request without cookie should be allowed")
+	assert.Empty(res.Header.Get("X-Forwarded-User"))
+
+	req = newDefaultHttpRequest("/public")
+	c := MakeCookie(req, "test@example.com")
+	c.Value += "x"
 	res, _ = doHttpRequest(req, c)
-	assert.Equal(401, res.StatusCode, "auth callback with invalid cookie shouldn't be authorised")
+	assert.Equal(200, res.StatusCode, "request with invalid cookie should be allowed")
+	assert.Empty(res.Header.Get("X-Forwarded-User"))
+
+	req = newDefaultHttpRequest("/public")
+	config.Whitelist = []string{"other@example.com"}
+	res, _ = doHttpRequest(req, MakeCookie(req, "test@example.com"))
+	assert.Equal(200, res.StatusCode, "request from disallowed user should be allowed")
+	assert.Empty(res.Header.Get("X-Forwarded-User"), "disallowed user should not be forwarded")
+}
 
-	// Should redirect valid request
-	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:http://redirect")
-	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+func TestServerAuthExpiresHeader(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	// Should not set header by default
+	req := newDefaultHttpRequest("/foo")
+	c := MakeCookie(req, "test@example.com")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Empty(res.Header.Get("X-Auth-Expires"), "expiry should not be set by default")
+
+	// Should set cookie expiry
+	config.AuthExpiresHeader = true
+	req = newDefaultHttpRequest("/foo")
 	res, _ = doHttpRequest(req, c)
-	assert.Equal(307, res.StatusCode, "valid auth callback should be allowed")
+	assert.Equal(200, res.StatusCode)
+	assert.Equal(strconv.FormatInt(c.Expires.Unix(), 10), res.Header.Get("X-Auth-Expires"))
 
-	fwd, _ := res.Location()
-	assert.Equal("http", fwd.Scheme, "valid request should be redirected to return url")
-	assert.Equal("redirect", fwd.Host, "valid request should be redirected to return url")
-	assert.Equal("", fwd.Path, "valid request should be redirected to return url")
+	// Should use the idle timeout when sooner
+	config.SessionIdleTimeout = time.Hour
+	req = newDefaultHttpRequest("/foo")
+	c = MakeCookie(req, "test@example.com")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	expires, err := strconv.ParseInt(res.Header.Get("X-Auth-Expires"), 10, 64)
+	assert.Nil(err)
+	assert.WithinDuration(time.Now().Add(time.Hour), time.Unix(expires, 0), 10*time.Second)
+
+	// Should not set header on unauthenticated request
+	config.DefaultAction = "allow"
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Empty(res.Header.Get("X-Auth-Expires"))
+}
+
+func TestServerAllowedResponseHeaders(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{})
+
+	headerNames := func(h http.Header) []string {
+		names := []string{}
+		for name := range h {
+			names = append(names, name)
+		}
+		return names
+	}
+
+	// Should only set user header on valid request
+	req := newDefaultHttpRequest("/foo")
+	c := MakeCookie(req, "test@example.com")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal([]string{"X-Forwarded-User"}, headerNames(res.Header), "unexpected response headers")
+
+	// Should set no headers on allowed request
+	config.DefaultAction = "allow"
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Len(res.Header, 0, "unexpected response headers")
+
+	// Should remove other headers
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Forwarded-User", "test@example.com")
+	w.Header().Set("X-Internal", "secret")
+	w.Header().Set("X-Extra", "value")
+	writeAllowed(w, newDefaultHttpRequest("/"))
+	assert.Equal(200, w.Code)
+	assert.Equal("test@example.com", w.Header().Get("X-Forwarded-User"))
+	assert.Equal("", w.Header().Get("X-Internal"), "header should be removed")
+	assert.Equal("", w.Header().Get("X-Extra"), "header should be removed")
+
+	// Should keep configured headers
+	config.AuthResponseHeaders = []string{"x-extra"}
+	w = httptest.NewRecorder()
+	w.Header().Set("X-Internal", "secret")
+	w.Header().Set("X-Extra", "value")
+	writeAllowed(w, newDefaultHttpRequest("/"))
+	assert.Equal("", w.Header().Get("X-Internal"), "header should be removed")
+	assert.Equal("value", w.Header().Get("X-Extra"), "configured header should be kept")
+}
+
+func TestServerCopyRequestHeaders(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--copy-request-header=x-request-id",
+		"--rule.public.action=allow",
+		"--rule.public.rule=Path(`/public`)",
+	})
+
+	// Should copy header when allowing request
+	req := newDefaultHttpRequest("/public")
+	req.Header.Set("X-Request-Id", "abc123")
+	req.Header.Set("X-Other", "value")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("abc123", res.Header.Get("X-Request-Id"), "header should be copied")
+	assert.Equal("", res.Header.Get("X-Other"), "other headers should not be copied")
+
+	// Should not copy header when denying request
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Request-Id", "abc123")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+	assert.Equal("", res.Header.Get("X-Request-Id"), "header should not be copied on redirect")
+
+	// Should not add header missing from request
+	req = newDefaultHttpRequest("/public")
+	res, _ = doHttpRequest(req, nil)
+	_, ok := res.Header["X-Request-Id"]
+	assert.False(ok, "missing header should not be added")
+}
+
+func TestServerRedactHeaders(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{"--log-redact-header=x-api-key"})
+
+	h := http.Header{}
+	h.Set("Cookie", "_forward_auth=secret")
+	h.Set("Authorization", "Bearer secret")
+	h.Set("X-Api-Key", "secret")
+	h.Set("X-Forwarded-Host", "example.com")
+
+	redacted := redactHeaders(h)
+	assert.Equal("[REDACTED]", redacted.Get("Cookie"))
+	assert.Equal("[REDACTED]", redacted.Get("Authorization"))
+	assert.Equal("[REDACTED]", redacted.Get("X-Api-Key"), "configured header should be redacted")
+	assert.Equal("example.com", redacted.Get("X-Forwarded-Host"))
+	assert.Equal("", redacted.Get("Proxy-Authorization"), "missing header should not be added")
+
+	// Should not modify original headers
+	assert.Equal("_forward_auth=secret", h.Get("Cookie"))
+}
+
+func TestServerCORSPreflight(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--cors-preflight",
+		"--cors-allowed-origin=https://app.example.com",
+	})
+
+	// Should allow preflight without auth
+	req := newHttpRequest("OPTIONS", "http://example.com/", "/api")
+	req.Header.Add("Origin", "https://app.example.com")
+	req.Header.Add("Access-Control-Request-Method", "POST")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(204, res.StatusCode, "preflight should be allowed")
+
+	// Should require auth for other origins
+	req = newHttpRequest("OPTIONS", "http://example.com/", "/api")
+	req.Header.Add("Origin", "https://evil.com")
+	req.Header.Add("Access-Control-Request-Method", "POST")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "preflight from other origin should require auth")
+
+	// Should require auth when disabled
+	config.CORSPreflight = false
+	req = newHttpRequest("OPTIONS", "http://example.com/", "/api")
+	req.Header.Add("Origin", "https://app.example.com")
+	req.Header.Add("Access-Control-Request-Method", "POST")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "preflight should require auth when disabled")
 }
 
 func TestServerDefaultAction(t *testing.T) {
@@ -161,6 +1668,56 @@ func TestServerDefaultAction(t *testing.T) {
 	assert.Equal(200, res.StatusCode, "request should be allowed with default handler")
 }
 
+func TestServerRoutePriority(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--rule.a-broad.action=allow",
+		"--rule.a-broad.rule=Host(`example.com`)",
+		"--rule.z-admin.rule=Host(`example.com`) && PathPrefix(`/admin`)",
+	})
+
+	// Should match rules with equal priority by name
+	req := newDefaultHttpRequest("/admin")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "broad rule should be matched first by name")
+
+	// Should match higher priority rule first
+	config.Rules["z-admin"].Priority = 10
+	req = newDefaultHttpRequest("/admin")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "higher priority specific rule should win")
+
+	req = newDefaultHttpRequest("/public")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "broad rule should still match other requests")
+}
+
+func TestServerRouteOwnPaths(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--rule.1.action=allow",
+		"--rule.1.rule=Host(`example.com`)",
+		"--rule.2.action=allow",
+		"--rule.2.rule=PathPrefix(`/_oauth`)",
+	})
+
+	// Should not let rules capture the callback
+	req := newDefaultHttpRequest("/_oauth")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode, "callback should not match rule")
+
+	// Should not let rules capture logout
+	req = newDefaultHttpRequest("/_oauth/logout")
+	res, body := doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode, "logout should not match rule")
+	assert.Equal("You have been logged out\n", body)
+
+	// Should still match rules on other paths
+	req = newDefaultHttpRequest("/_oauthother")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "other paths should match rule")
+}
+
 func TestServerRouteHeaders(t *testing.T) {
 	assert := assert.New(t)
 	config, _ = NewConfig([]string{})
@@ -224,6 +1781,80 @@ func TestServerRouteHost(t *testing.T) {
 	assert.Equal(200, res.StatusCode, "request matching allow rule should be allowed")
 }
 
+func TestServerRouteHostPort(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--cookie-domain=example.com",
+		"--cookie-domain=test.org",
+		"--rule.1.action=allow",
+		"--rule.1.rule=Host(`api.example.com`)",
+		"--rule.2.action=allow",
+		"--rule.2.rule=HostRegexp(`sub{num:[0-9]}.test.org`)",
+	})
+
+	// Should match host rules ignoring the port
+	req := newHttpRequest("GET", "https://api.example.com:8443/", "/")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "host with port should match host rule")
+
+	req = newHttpRequest("GET", "https://sub8.test.org:8443/", "/")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "host with port should match host regexp rule")
+
+	req = newHttpRequest("GET", "https://app.example.com:8443/", "/")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "host with port not matching any rule should require auth")
+
+	// Should select cookie domain ignoring the port
+	req = newHttpRequest("GET", "https://app.example.com:8443/", "/")
+	c := MakeCookie(req, "test@example.com")
+	assert.Equal("example.com", c.Domain)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "cookie for host with port should be valid")
+
+	req = newHttpRequest("GET", "https://app.test.org:8443/", "/")
+	assert.Equal("test.org", MakeCookie(req, "test@example.com").Domain)
+}
+
+func TestServerRouteHostTrailingDot(t *testing.T) {
+	assert := assert.New(t)
+	config, _ = NewConfig([]string{
+		"--cookie-domain=example.com",
+		"--rule.1.action=allow",
+		"--rule.1.rule=Host(`public.example.com`)",
+	})
+
+	// Should match rule
+	req := newHttpRequest("", "http://Public.Example.com./", "/")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "trailing dot host should match rule")
+
+	// Should set cookie on normalised domain
+	req = newHttpRequest("", "http://app.example.com./", "/")
+	req.Header.Add("X-Forwarded-Proto", "http")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "trailing dot host should be authenticated")
+	if cookies := res.Cookies(); assert.Len(cookies, 1) {
+		assert.Equal("app.example.com", cookies[0].Domain)
+	}
+	fwd, _ := res.Location()
+	assert.Equal("http://app.example.com/_oauth", fwd.Query().Get("redirect_uri"))
+
+	// Should accept cookie for normalised domain
+	req = newHttpRequest("", "http://app.example.com./", "/")
+	c := MakeCookie(newHttpRequest("", "http://app.example.com/", "/"), "test@example.com")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "cookie should be valid on trailing dot host")
+}
+
+func TestServerNormalizeHost(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("app.example.com", normalizeHost("App.Example.com."))
+	assert.Equal("app.example.com:8080", normalizeHost("app.example.com.:8080"))
+	assert.Equal("[::1]:8080", normalizeHost("[::1]:8080"))
+	assert.Equal("app.example.com", normalizeHost("app.example.com"))
+}
+
 func TestServerRouteMethod(t *testing.T) {
 	assert := assert.New(t)
 	config, _ = NewConfig([]string{})
@@ -243,6 +1874,27 @@ func TestServerRouteMethod(t *testing.T) {
 	req = newHttpRequest("PUT", "https://example.com/", "/")
 	res, _ = doHttpRequest(req, nil)
 	assert.Equal(200, res.StatusCode, "request matching allow rule should be allowed")
+
+	// Should use request method when forwarded method is missing
+	req = httptest.NewRequest("PUT", "http://should-use-x-forwarded.com", nil)
+	req.Header.Add("X-Forwarded-Host", "example.com")
+	req.Header.Add("X-Forwarded-Uri", "/")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "request method should be used without forwarded method")
+
+	// Should reject invalid method
+	req = newHttpRequest("P(T", "https://example.com/", "/")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(400, res.StatusCode, "invalid method should be rejected")
+}
+
+func TestServerValidMethod(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(validMethod("GET"))
+	assert.True(validMethod("PROPFIND"))
+	assert.False(validMethod(""))
+	assert.False(validMethod("GET /"))
+	assert.False(validMethod("GÉT"))
 }
 
 func TestServerRoutePath(t *testing.T) {
@@ -300,6 +1952,30 @@ func TestServerRouteQuery(t *testing.T) {
 	assert.Equal(200, res.StatusCode, "request matching allow rule should be allowed")
 }
 
+/**
+ * Benchmarks
+ */
+
+func BenchmarkServerBuildRoutes(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("%d rules", n), func(b *testing.B) {
+			config, _ = NewConfig([]string{})
+			config.Rules = make(map[string]*Rule, n)
+			for i := 0; i < n; i++ {
+				config.Rules[fmt.Sprintf("%d", i)] = &Rule{
+					Action: "allow",
+					Rule:   fmt.Sprintf("Host(`%d.example.com`) && PathPrefix(`/api/%d`)", i, i),
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				NewServer()
+			}
+		})
+	}
+}
+
 /**
  * Utilities
  */
@@ -333,6 +2009,7 @@ func doHttpRequest(r *http.Request, c *http.Cookie) (*http.Response, string) {
 	for _, c := range w.HeaderMap["Set-Cookie"] {
 		r.Header.Add("Cookie", c)
 	}
+	w.Header().Del("Set-Cookie")
 
 	NewServer().RootHandler(w, r)
 